@@ -8,6 +8,5 @@ import (
 
 func Init(api unsafe.Pointer) error {
 	myApi := ((*web.API)(api))
-	plugin.InitIstioPlugin(myApi)
-	return nil
+	return plugin.InitIstioPlugin(myApi)
 }
@@ -0,0 +1,239 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	coordination "k8s.io/api/coordination/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	concurrencyError   = "ConcurrencyError"
+	bindingLeasePrefix = "istio-binding-lock-"
+	leaseRetryInterval = 250 * time.Millisecond
+)
+
+// BindingLock serializes the operations on a binding, e.g. a bind and an unbind of the same binding id
+type BindingLock interface {
+	// Lock blocks until the binding is locked and returns the function that unlocks it. If the binding can't be
+	// locked in time, an OSB ConcurrencyError is returned.
+	Lock(ctx context.Context, bindId string) (func(), error)
+}
+
+func newConcurrencyError(bindId string) error {
+	return &model.HttpError{
+		ErrorMsg:    concurrencyError,
+		Description: fmt.Sprintf("Another operation for binding %s is in progress", bindId),
+		StatusCode:  http.StatusUnprocessableEntity}
+}
+
+type bindingMutex struct {
+	locked chan struct{}
+	users  int
+}
+
+// localBindingLock locks bindings within the process
+type localBindingLock struct {
+	timeout time.Duration
+	mutex   sync.Mutex
+	locks   map[string]*bindingMutex
+}
+
+func newLocalBindingLock(timeout time.Duration) *localBindingLock {
+	return &localBindingLock{timeout: timeout, locks: make(map[string]*bindingMutex)}
+}
+
+func (l *localBindingLock) Lock(ctx context.Context, bindId string) (func(), error) {
+	return l.lockUntil(ctx, bindId, time.Now().Add(l.timeout))
+}
+
+// lockUntil blocks until the binding is locked or the deadline passed
+func (l *localBindingLock) lockUntil(ctx context.Context, bindId string, deadline time.Time) (func(), error) {
+	l.mutex.Lock()
+	lock, ok := l.locks[bindId]
+	if !ok {
+		lock = &bindingMutex{locked: make(chan struct{}, 1)}
+		l.locks[bindId] = lock
+	}
+	lock.users++
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case lock.locked <- struct{}{}:
+		return func() {
+			<-lock.locked
+			l.release(bindId, lock)
+		}, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	l.release(bindId, lock)
+	return nil, newConcurrencyError(bindId)
+}
+
+func (l *localBindingLock) release(bindId string, lock *bindingMutex) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lock.users--
+	if lock.users == 0 {
+		delete(l.locks, bindId)
+	}
+}
+
+// LeaseStore reads and writes the coordination.k8s.io leases in the namespace of the plugin
+type LeaseStore interface {
+	GetLease(string) (*coordination.Lease, error)
+	CreateLease(*coordination.Lease) (*coordination.Lease, error)
+	UpdateLease(*coordination.Lease) (*coordination.Lease, error)
+	DeleteLease(string) error
+}
+
+// leaseBindingLock additionally locks bindings across the replicas of the proxy with a lease per binding.
+// The lease is renewed while the binding is locked. A lease that is not released, e.g. because its holder
+// crashed, can be taken over after its duration.
+type leaseBindingLock struct {
+	local         *localBindingLock
+	leases        LeaseStore
+	holder        string
+	duration      time.Duration
+	renewInterval time.Duration
+}
+
+func newLeaseBindingLock(timeout time.Duration, leases LeaseStore, holder string, duration time.Duration) *leaseBindingLock {
+	return &leaseBindingLock{local: newLocalBindingLock(timeout), leases: leases, holder: holder, duration: duration,
+		renewInterval: duration / 3}
+}
+
+func bindingLeaseName(bindId string) string {
+	return subdomainName(bindingLeasePrefix, bindId)
+}
+
+func (l *leaseBindingLock) Lock(ctx context.Context, bindId string) (func(), error) {
+	// the lock timeout covers waiting for the local lock and for the lease
+	deadline := time.Now().Add(l.local.timeout)
+	unlock, err := l.local.lockUntil(ctx, bindId, deadline)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		acquired, err := l.tryAcquire(bindId)
+		if err != nil {
+			unlock()
+			return nil, fmt.Errorf("Can't acquire lease of binding %s: %s", bindId, err.Error())
+		}
+		if acquired {
+			stop := make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				l.renew(ctx, bindId, stop)
+			}()
+			return func() {
+				close(stop)
+				<-stopped
+				l.release(ctx, bindId)
+				unlock()
+			}, nil
+		}
+		if time.Now().Add(leaseRetryInterval).After(deadline) {
+			unlock()
+			return nil, newConcurrencyError(bindId)
+		}
+		select {
+		case <-ctx.Done():
+			unlock()
+			return nil, newConcurrencyError(bindId)
+		case <-time.After(leaseRetryInterval):
+		}
+	}
+}
+
+// tryAcquire returns true if the lease of the binding was created, or taken over because it was released or expired
+func (l *leaseBindingLock) tryAcquire(bindId string) (bool, error) {
+	now := meta_v1.NewMicroTime(time.Now())
+	durationSeconds := int32(l.duration / time.Second)
+	lease, err := l.leases.GetLease(bindingLeaseName(bindId))
+	if errors.IsNotFound(err) {
+		lease = &coordination.Lease{}
+		lease.Name = bindingLeaseName(bindId)
+		lease.Labels = BindingMetadata{BindingId: bindId}.Labels()
+		lease.Spec = coordination.LeaseSpec{HolderIdentity: &l.holder, LeaseDurationSeconds: &durationSeconds, AcquireTime: &now, RenewTime: &now}
+		_, err = l.leases.CreateLease(lease)
+		if errors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if isLeaseHeld(lease.Spec, now.Time) {
+		return false, nil
+	}
+	transitions := int32(1)
+	if lease.Spec.LeaseTransitions != nil {
+		transitions += *lease.Spec.LeaseTransitions
+	}
+	lease.Spec = coordination.LeaseSpec{HolderIdentity: &l.holder, LeaseDurationSeconds: &durationSeconds, AcquireTime: &now, RenewTime: &now, LeaseTransitions: &transitions}
+	_, err = l.leases.UpdateLease(lease)
+	if errors.IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func isLeaseHeld(spec coordination.LeaseSpec, now time.Time) bool {
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	return spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second).After(now)
+}
+
+// renew updates the renew time of the lease of the binding until stop is closed or the lease was taken over
+func (l *leaseBindingLock) renew(ctx context.Context, bindId string, stop <-chan struct{}) {
+	ticker := time.NewTicker(l.renewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		lease, err := l.leases.GetLease(bindingLeaseName(bindId))
+		if err == nil && (lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.holder) {
+			loggerFor(ctx).Warnf("Lease of binding %s was taken over before the operation finished", bindId)
+			return
+		}
+		if err == nil {
+			now := meta_v1.NewMicroTime(time.Now())
+			lease.Spec.RenewTime = &now
+			_, err = l.leases.UpdateLease(lease)
+		}
+		if err != nil {
+			loggerFor(ctx).Warnf("Can't renew lease of binding %s: %s", bindId, err.Error())
+		}
+	}
+}
+
+// release deletes the lease of the binding unless it was taken over by another replica
+func (l *leaseBindingLock) release(ctx context.Context, bindId string) {
+	lease, err := l.leases.GetLease(bindingLeaseName(bindId))
+	if err == nil && (lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.holder) {
+		loggerFor(ctx).Warnf("Lease of binding %s was taken over before the operation finished", bindId)
+		return
+	}
+	if err == nil {
+		err = l.leases.DeleteLease(bindingLeaseName(bindId))
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		loggerFor(ctx).Warnf("Can't release lease of binding %s, it expires after %s: %s", bindId, l.duration, err.Error())
+	}
+}
@@ -0,0 +1,344 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"github.com/Peripli/service-manager/pkg/web"
+	. "github.com/onsi/gomega"
+	coordination "k8s.io/api/coordination/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var leasesResource = schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}
+
+// mockLeaseStore keeps leases in memory and rejects updates of outdated leases like the API server
+type mockLeaseStore struct {
+	leases  map[string]coordination.Lease
+	version int
+	mutex   sync.Mutex
+}
+
+func newMockLeaseStore() *mockLeaseStore {
+	return &mockLeaseStore{leases: make(map[string]coordination.Lease)}
+}
+
+func (m *mockLeaseStore) GetLease(name string) (*coordination.Lease, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	lease, ok := m.leases[name]
+	if !ok {
+		return nil, errors.NewNotFound(leasesResource, name)
+	}
+	return lease.DeepCopy(), nil
+}
+
+func (m *mockLeaseStore) CreateLease(lease *coordination.Lease) (*coordination.Lease, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.leases[lease.Name]; ok {
+		return nil, errors.NewAlreadyExists(leasesResource, lease.Name)
+	}
+	return m.store(lease), nil
+}
+
+func (m *mockLeaseStore) UpdateLease(lease *coordination.Lease) (*coordination.Lease, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	current, ok := m.leases[lease.Name]
+	if !ok {
+		return nil, errors.NewNotFound(leasesResource, lease.Name)
+	}
+	if current.ResourceVersion != lease.ResourceVersion {
+		return nil, errors.NewConflict(leasesResource, lease.Name, nil)
+	}
+	return m.store(lease), nil
+}
+
+func (m *mockLeaseStore) DeleteLease(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.leases[name]; !ok {
+		return errors.NewNotFound(leasesResource, name)
+	}
+	delete(m.leases, name)
+	return nil
+}
+
+func (m *mockLeaseStore) store(lease *coordination.Lease) *coordination.Lease {
+	m.version++
+	stored := lease.DeepCopy()
+	stored.ResourceVersion = strconv.Itoa(m.version)
+	m.leases[lease.Name] = *stored
+	return stored.DeepCopy()
+}
+
+func expectConcurrencyError(g *GomegaWithT, err error) {
+	g.Expect(err).To(HaveOccurred())
+	httpError := err.(*model.HttpError)
+	g.Expect(httpError.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+	g.Expect(httpError.ErrorMsg).To(Equal("ConcurrencyError"))
+}
+
+func TestLocalBindingLockTimesOut(t *testing.T) {
+	g := NewGomegaWithT(t)
+	lock := newLocalBindingLock(20 * time.Millisecond)
+	unlock, err := lock.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	_, err = lock.Lock(context.Background(), "bind-id")
+
+	expectConcurrencyError(g, err)
+	unlock()
+	g.Expect(lock.locks).To(BeEmpty())
+}
+
+func TestLocalBindingLockIsPerBinding(t *testing.T) {
+	g := NewGomegaWithT(t)
+	lock := newLocalBindingLock(20 * time.Millisecond)
+	unlock, err := lock.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer unlock()
+
+	unlockOther, err := lock.Lock(context.Background(), "other-id")
+
+	g.Expect(err).NotTo(HaveOccurred())
+	unlockOther()
+}
+
+func TestLocalBindingLockWaitsForUnlock(t *testing.T) {
+	g := NewGomegaWithT(t)
+	lock := newLocalBindingLock(time.Second)
+	unlock, err := lock.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	time.AfterFunc(20*time.Millisecond, unlock)
+
+	unlock, err = lock.Lock(context.Background(), "bind-id")
+
+	g.Expect(err).NotTo(HaveOccurred())
+	unlock()
+}
+
+func TestLocalBindingLockSerializesOperations(t *testing.T) {
+	g := NewGomegaWithT(t)
+	lock := newLocalBindingLock(time.Second)
+	running := 0
+	maxRunning := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lock.Lock(context.Background(), "bind-id")
+			if err != nil {
+				return
+			}
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			time.Sleep(time.Millisecond)
+			running--
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	g.Expect(maxRunning).To(Equal(1))
+	g.Expect(lock.locks).To(BeEmpty())
+}
+
+func TestLocalBindingLockStopsWaitingOnCancel(t *testing.T) {
+	g := NewGomegaWithT(t)
+	lock := newLocalBindingLock(time.Minute)
+	unlock, err := lock.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = lock.Lock(ctx, "bind-id")
+
+	expectConcurrencyError(g, err)
+}
+
+func TestLeaseBindingLockAcrossReplicas(t *testing.T) {
+	g := NewGomegaWithT(t)
+	leases := newMockLeaseStore()
+	replicaA := newLeaseBindingLock(100*time.Millisecond, leases, "replica-a", time.Minute)
+	replicaB := newLeaseBindingLock(100*time.Millisecond, leases, "replica-b", time.Minute)
+	unlock, err := replicaA.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	lease, err := leases.GetLease("istio-binding-lock-bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(*lease.Spec.HolderIdentity).To(Equal("replica-a"))
+	g.Expect(lease.Labels).To(HaveKeyWithValue(bindingIdKey, "bind-id"))
+
+	_, err = replicaB.Lock(context.Background(), "bind-id")
+
+	expectConcurrencyError(g, err)
+	unlock()
+	g.Expect(leases.leases).To(BeEmpty())
+	unlock, err = replicaB.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	unlock()
+}
+
+func TestLeaseBindingLockTimeoutIncludesWaitForLocalLock(t *testing.T) {
+	g := NewGomegaWithT(t)
+	leases := newMockLeaseStore()
+	replicaA := newLeaseBindingLock(time.Minute, leases, "replica-a", time.Minute)
+	replicaB := newLeaseBindingLock(400*time.Millisecond, leases, "replica-b", time.Minute)
+	unlockA, err := replicaA.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer unlockA()
+	unlockB, err := replicaB.local.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	time.AfterFunc(300*time.Millisecond, unlockB)
+	start := time.Now()
+
+	_, err = replicaB.Lock(context.Background(), "bind-id")
+
+	expectConcurrencyError(g, err)
+	g.Expect(time.Since(start)).To(BeNumerically("<", 400*time.Millisecond))
+}
+
+func TestLeaseBindingLockTakesOverExpiredLease(t *testing.T) {
+	g := NewGomegaWithT(t)
+	leases := newMockLeaseStore()
+	expired := meta_v1.NewMicroTime(time.Now().Add(-2 * time.Minute))
+	holder := "crashed-replica"
+	duration := int32(60)
+	lease := &coordination.Lease{Spec: coordination.LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &duration, RenewTime: &expired}}
+	lease.Name = "istio-binding-lock-bind-id"
+	leases.CreateLease(lease)
+	lock := newLeaseBindingLock(100*time.Millisecond, leases, "replica-a", time.Minute)
+
+	unlock, err := lock.Lock(context.Background(), "bind-id")
+
+	g.Expect(err).NotTo(HaveOccurred())
+	lease, err = leases.GetLease("istio-binding-lock-bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(*lease.Spec.HolderIdentity).To(Equal("replica-a"))
+	g.Expect(*lease.Spec.LeaseTransitions).To(Equal(int32(1)))
+	unlock()
+}
+
+func TestLeaseBindingLockRenewsLeaseUntilUnlock(t *testing.T) {
+	g := NewGomegaWithT(t)
+	leases := newMockLeaseStore()
+	lock := newLeaseBindingLock(100*time.Millisecond, leases, "replica-a", time.Minute)
+	lock.renewInterval = time.Millisecond
+	unlock, err := lock.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	acquired, err := leases.GetLease("istio-binding-lock-bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Eventually(func() bool {
+		lease, err := leases.GetLease("istio-binding-lock-bind-id")
+		return err == nil && lease.Spec.RenewTime.After(acquired.Spec.RenewTime.Time)
+	}).Should(BeTrue())
+	unlock()
+
+	_, err = leases.GetLease("istio-binding-lock-bind-id")
+	g.Expect(errors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestLeaseBindingLockKeepsLeaseTakenOver(t *testing.T) {
+	g := NewGomegaWithT(t)
+	leases := newMockLeaseStore()
+	lock := newLeaseBindingLock(100*time.Millisecond, leases, "replica-a", time.Minute)
+	unlock, err := lock.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	lease, _ := leases.GetLease("istio-binding-lock-bind-id")
+	holder := "replica-b"
+	lease.Spec.HolderIdentity = &holder
+	leases.UpdateLease(lease)
+
+	unlock()
+
+	g.Expect(leases.leases).To(HaveKey("istio-binding-lock-bind-id"))
+}
+
+func TestIstioPluginBindWhileBindingIsLocked(t *testing.T) {
+	g := NewGomegaWithT(t)
+	lock := newLocalBindingLock(20 * time.Millisecond)
+	plugin := IstioPlugin{interceptor: &SpyPostBindInterceptor{}, bindingLock: lock}
+	unlock, err := lock.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer unlock()
+	nextHandler := SpyWebHandler{}
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/instance-id/service_bindings/bind-id")
+	request := web.Request{Request: &http.Request{URL: origURL, Method: http.MethodPut}, Body: []byte("{}")}
+
+	response, err := plugin.Bind(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+	var httpError model.HttpError
+	g.Expect(json.Unmarshal(response.Body, &httpError)).To(Succeed())
+	g.Expect(httpError.ErrorMsg).To(Equal("ConcurrencyError"))
+	g.Expect(nextHandler.url.Path).To(BeEmpty())
+}
+
+func TestIstioPluginUnbindWhileBindingIsLocked(t *testing.T) {
+	g := NewGomegaWithT(t)
+	lock := newLocalBindingLock(20 * time.Millisecond)
+	plugin := IstioPlugin{interceptor: &SpyPostBindInterceptor{}, bindingLock: lock}
+	unlock, err := lock.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer unlock()
+	nextHandler := SpyWebHandler{}
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/instance-id/service_bindings/bind-id")
+	request := web.Request{Request: &http.Request{URL: origURL, Method: http.MethodDelete}}
+
+	response, err := plugin.Unbind(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+	g.Expect(nextHandler.url.Path).To(BeEmpty())
+}
+
+func TestIstioPluginPollBindingWhileBindingIsLocked(t *testing.T) {
+	g := NewGomegaWithT(t)
+	lock := newLocalBindingLock(20 * time.Millisecond)
+	interceptor := SpyPostBindInterceptor{}
+	plugin := IstioPlugin{interceptor: &interceptor, bindingLock: lock}
+	unlock, err := lock.Lock(context.Background(), "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer unlock()
+	nextHandler := SpyWebHandler{lastOperationResponseBody: []byte(`{"state": "succeeded"}`)}
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/instance-id/service_bindings/bind-id/last_operation")
+	request := web.Request{Request: &http.Request{URL: origURL, Method: http.MethodGet}}
+
+	response, err := plugin.PollBinding(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusOK))
+	g.Expect(string(response.Body)).To(MatchJSON(`{"state": "in progress"}`))
+	g.Expect(interceptor.bindId).To(BeEmpty())
+}
+
+func TestCreateBindingLock(t *testing.T) {
+	g := NewGomegaWithT(t)
+	settings := DefaultSettings()
+
+	lock, err := createBindingLock(settings, &MockConfigStore{})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(lock).To(Equal(newLocalBindingLock(settings.LockTimeout)))
+
+	settings.LockLease = true
+	_, err = createBindingLock(settings, &MockConfigStore{})
+
+	g.Expect(err).To(HaveOccurred())
+}
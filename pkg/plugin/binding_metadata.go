@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"encoding/json"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	metadataPrefix      = "istio-plugin.peripli.io/"
+	bindingIdKey        = metadataPrefix + "binding-id"
+	instanceIdKey       = metadataPrefix + "instance-id"
+	serviceIdKey        = metadataPrefix + "service-id"
+	planIdKey           = metadataPrefix + "plan-id"
+	consumerIdKey       = metadataPrefix + "consumer-id"
+	networkProfileKey   = metadataPrefix + "network-profile"
+	pluginVersionKey    = metadataPrefix + "plugin-version"
+	managedByLabel      = "app.kubernetes.io/managed-by"
+	managedByLabelValue = "service-manager-istio-plugin"
+)
+
+// Version of the plugin, set during the build with -ldflags "-X ...plugin.Version=<version>"
+var Version = "dev"
+
+// BindingMetadata identifies the binding that generated kubernetes and istio objects belong to.
+// It is attached to these objects as labels, where the values are valid label values, and always as annotations.
+type BindingMetadata struct {
+	BindingId      string `json:"binding_id"`
+	InstanceId     string `json:"instance_id,omitempty"`
+	ServiceId      string `json:"service_id,omitempty"`
+	PlanId         string `json:"plan_id,omitempty"`
+	ConsumerId     string `json:"consumer_id,omitempty"`
+	NetworkProfile string `json:"network_profile,omitempty"`
+}
+
+func (m BindingMetadata) values() map[string]string {
+	return map[string]string{
+		bindingIdKey:      m.BindingId,
+		instanceIdKey:     m.InstanceId,
+		serviceIdKey:      m.ServiceId,
+		planIdKey:         m.PlanId,
+		consumerIdKey:     m.ConsumerId,
+		networkProfileKey: m.NetworkProfile,
+		pluginVersionKey:  Version,
+	}
+}
+
+// Labels returns the metadata that are valid label values. Binding ids that aren't are normalized and hashed,
+// the annotation keeps the full binding id.
+func (m BindingMetadata) Labels() map[string]string {
+	result := map[string]string{managedByLabel: managedByLabelValue}
+	for key, value := range m.values() {
+		if key == bindingIdKey {
+			value = bindingLabelValue(value)
+		}
+		if value != "" && len(validation.IsValidLabelValue(value)) == 0 {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+func (m BindingMetadata) Annotations() map[string]string {
+	result := make(map[string]string)
+	for key, value := range m.values() {
+		if value != "" {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// BindingSelector selects all objects generated for the given binding
+func BindingSelector(bindId string) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{managedByLabel: managedByLabelValue, bindingIdKey: bindingLabelValue(bindId)})
+}
+
+// ManagedSelector selects all objects generated by the plugin
+func ManagedSelector() labels.Selector {
+	return labels.SelectorFromSet(labels.Set{managedByLabel: managedByLabelValue})
+}
+
+func mergeInto(target map[string]string, values map[string]string) map[string]string {
+	if target == nil {
+		target = make(map[string]string)
+	}
+	for key, value := range values {
+		target[key] = value
+	}
+	return target
+}
+
+func additionalString(properties model.AdditionalProperties, key string) string {
+	var value string
+	if raw, ok := properties[key]; ok {
+		json.Unmarshal(raw, &value)
+	}
+	return value
+}
@@ -0,0 +1,22 @@
+package plugin
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestBindingMetadataLabelsSkipInvalidValues(t *testing.T) {
+	g := NewGomegaWithT(t)
+	metadata := BindingMetadata{BindingId: "bind-id", ConsumerId: "client.istio.sapcloud.io", NetworkProfile: "urn:local.test:public"}
+
+	labels := metadata.Labels()
+	annotations := metadata.Annotations()
+
+	g.Expect(labels).To(HaveKeyWithValue(bindingIdKey, "bind-id"))
+	g.Expect(labels).To(HaveKeyWithValue(consumerIdKey, "client.istio.sapcloud.io"))
+	g.Expect(labels).NotTo(HaveKey(networkProfileKey))
+	g.Expect(labels).NotTo(HaveKey(instanceIdKey))
+	g.Expect(annotations).To(HaveKeyWithValue(networkProfileKey, "urn:local.test:public"))
+	g.Expect(annotations).NotTo(HaveKey(managedByLabel))
+}
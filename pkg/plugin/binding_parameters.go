@@ -0,0 +1,125 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"github.com/gogo/protobuf/jsonpb"
+	"istio.io/api/networking/v1alpha3"
+	istioModel "istio.io/istio/pilot/pkg/model"
+)
+
+// bindingParametersKey is the reserved key of the bind parameters that holds the BindingParameters.
+// It is removed from the parameters before the bind request is forwarded to the broker.
+const bindingParametersKey = "istio"
+
+// BindingParameters are the service mesh options the platform chose for a single binding
+type BindingParameters struct {
+	// Disabled bypasses the service mesh, the application connects to the provider directly
+	Disabled bool `json:"disabled,omitempty"`
+	// Port of the local services the application connects to, see ConsumerInterceptor.servicePort if not set
+	Port int32 `json:"port,omitempty"`
+	// TrafficPolicy of the connections to the provider, in the format of an istio DestinationRule traffic policy.
+	// Only loadBalancer, connectionPool and outlierDetection may be set, TLS is managed by the plugin.
+	TrafficPolicy json.RawMessage `json:"traffic_policy,omitempty"`
+}
+
+func (p BindingParameters) isSet() bool {
+	return p.Disabled || p.Port != 0 || len(p.TrafficPolicy) != 0
+}
+
+func (p BindingParameters) trafficPolicy() (*v1alpha3.TrafficPolicy, error) {
+	if len(p.TrafficPolicy) == 0 {
+		return nil, nil
+	}
+	var policy v1alpha3.TrafficPolicy
+	err := (&jsonpb.Unmarshaler{}).Unmarshal(bytes.NewReader(p.TrafficPolicy), &policy)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Tls != nil || len(policy.PortLevelSettings) != 0 {
+		return nil, fmt.Errorf("only loadBalancer, connectionPool and outlierDetection are supported")
+	}
+	return &policy, nil
+}
+
+func (p BindingParameters) validate() error {
+	if p.Port < 0 || p.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", p.Port)
+	}
+	if _, err := p.trafficPolicy(); err != nil {
+		return fmt.Errorf("invalid traffic_policy: %s", err.Error())
+	}
+	return nil
+}
+
+// takeBindingParameters returns the binding parameters of the bind request, the request without them and
+// true if the request contained them
+func takeBindingParameters(request model.BindRequest) (BindingParameters, model.BindRequest, bool, error) {
+	var parameters map[string]json.RawMessage
+	raw, ok := request.AdditionalProperties["parameters"]
+	if !ok || json.Unmarshal(raw, &parameters) != nil {
+		return BindingParameters{}, request, false, nil
+	}
+	options, ok := parameters[bindingParametersKey]
+	if !ok {
+		return BindingParameters{}, request, false, nil
+	}
+
+	var result BindingParameters
+	decoder := json.NewDecoder(bytes.NewReader(options))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&result)
+	if err == nil {
+		err = result.validate()
+	}
+	if err != nil {
+		return BindingParameters{}, request, false, invalidParametersError(err)
+	}
+
+	delete(parameters, bindingParametersKey)
+	stripped, err := json.Marshal(parameters)
+	if err != nil {
+		return BindingParameters{}, request, false, err
+	}
+	properties := make(model.AdditionalProperties, len(request.AdditionalProperties))
+	for key, value := range request.AdditionalProperties {
+		properties[key] = value
+	}
+	properties["parameters"] = stripped
+	request.AdditionalProperties = properties
+	return result, request, true, nil
+}
+
+func invalidParametersError(err error) error {
+	return &model.HttpError{
+		ErrorMsg:    "BadRequest",
+		Description: fmt.Sprintf("Invalid bind parameters %s: %s", bindingParametersKey, err.Error()),
+		StatusCode:  http.StatusBadRequest}
+}
+
+// applyTrafficPolicy sets the traffic policy on the destination rule of the given host. The subsets and their port
+// level settings keep their TLS settings.
+func applyTrafficPolicy(configuration istioModel.Config, host string, policy *v1alpha3.TrafficPolicy) {
+	destinationRule, ok := configuration.Spec.(*v1alpha3.DestinationRule)
+	if policy == nil || !ok || destinationRule.Host != host {
+		return
+	}
+	for _, subset := range destinationRule.Subsets {
+		if subset.TrafficPolicy == nil {
+			subset.TrafficPolicy = &v1alpha3.TrafficPolicy{}
+		}
+		subset.TrafficPolicy.LoadBalancer = policy.LoadBalancer
+		subset.TrafficPolicy.ConnectionPool = policy.ConnectionPool
+		subset.TrafficPolicy.OutlierDetection = policy.OutlierDetection
+		// port level settings don't inherit from the subset
+		for _, portSettings := range subset.TrafficPolicy.PortLevelSettings {
+			portSettings.LoadBalancer = policy.LoadBalancer
+			portSettings.ConnectionPool = policy.ConnectionPool
+			portSettings.OutlierDetection = policy.OutlierDetection
+		}
+	}
+}
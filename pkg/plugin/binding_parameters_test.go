@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"github.com/Peripli/istio-broker-proxy/pkg/router"
+	"github.com/Peripli/service-manager/pkg/web"
+	. "github.com/onsi/gomega"
+	"istio.io/api/networking/v1alpha3"
+)
+
+func interceptorForBind(configStore ConfigStore) router.ServiceBrokerInterceptor {
+	request := &web.Request{Request: &http.Request{URL: &url.URL{Path: "/v1/osb/broker/v2/service_instances/instance/service_bindings/bind-id"}}}
+	interceptor := ConsumerInterceptor{ConsumerId: "consumer", ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	return interceptor.ForRequest(request, requestIdsOf(request))
+}
+
+func TestPreBindStripsBindingParameters(t *testing.T) {
+	g := NewGomegaWithT(t)
+	bindRequest := bindRequestWithParameters(`{"size": "small", "istio": {"port": 5432}}`)
+
+	request, err := interceptorForBind(&MockConfigStore{}).PreBind(bindRequest)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(request.AdditionalProperties["parameters"])).To(MatchJSON(`{"size": "small"}`))
+	g.Expect(string(bindRequest.AdditionalProperties["parameters"])).To(MatchJSON(`{"size": "small", "istio": {"port": 5432}}`))
+	g.Expect(request.NetworkData.NetworkProfileId).To(Equal("urn:local.test:public"))
+}
+
+func TestPreBindRejectsInvalidBindingParameters(t *testing.T) {
+	for _, parameters := range []string{
+		`{"istio": {"port": 70000}}`,
+		`{"istio": {"unknown": true}}`,
+		`{"istio": {"traffic_policy": {"tls": {"mode": "DISABLE"}}}}`,
+		`{"istio": {"traffic_policy": {"connectionPool": {"tcp": {"connectTimeout": "soon"}}}}}`,
+	} {
+		g := NewGomegaWithT(t)
+
+		_, err := interceptorForBind(&MockConfigStore{}).PreBind(bindRequestWithParameters(parameters))
+
+		g.Expect(err).To(HaveOccurred(), parameters)
+		g.Expect(err.(*model.HttpError).StatusCode).To(Equal(http.StatusBadRequest))
+	}
+}
+
+func TestBindingParametersDisableServiceMesh(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := interceptorForBind(configStore)
+
+	request, err := interceptor.PreBind(bindRequestWithParameters(`{"istio": {"disabled": true}}`))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(request.NetworkData.Data.ConsumerId).To(BeEmpty())
+
+	binding, err := interceptor.PostBind(*request, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{providerEndpoint}))
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+	g.Expect(configStore.BindingRecords).To(BeEmpty())
+}
+
+func TestBindingParametersChooseServicePort(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := interceptorForBind(configStore)
+	request, err := interceptor.PreBind(bindRequestWithParameters(`{"istio": {"port": 5432}}`))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	binding, err := interceptor.PostBind(*request, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 5432}}))
+	g.Expect(configStore.CreatedServices[0].Spec.Ports[0].Port).To(Equal(int32(5432)))
+	g.Expect(configStore.BindingRecords["bind-id"].Parameters.Port).To(Equal(int32(5432)))
+
+	fetched, err := interceptor.(bindingFetchInterceptor).PostFetchBinding(bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(fetched.Endpoints).To(Equal(binding.Endpoints))
+}
+
+func TestBindingParametersSetTrafficPolicy(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := interceptorForBind(configStore)
+	request, err := interceptor.PreBind(bindRequestWithParameters(
+		`{"istio": {"traffic_policy": {"connectionPool": {"tcp": {"maxConnections": 10}}, "outlierDetection": {"consecutiveErrors": 3}}}}`))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	_, err = interceptor.PostBind(*request, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	var providerRules, otherRules []*v1alpha3.DestinationRule
+	for _, config := range configStore.CreatedIstioConfigs {
+		if rule, ok := config.Spec.(*v1alpha3.DestinationRule); ok {
+			if rule.Host == providerEndpoint.Host {
+				providerRules = append(providerRules, rule)
+			} else {
+				otherRules = append(otherRules, rule)
+			}
+		}
+	}
+	g.Expect(providerRules).To(HaveLen(1))
+	policy := providerRules[0].Subsets[0].TrafficPolicy
+	g.Expect(policy.ConnectionPool.Tcp.MaxConnections).To(Equal(int32(10)))
+	g.Expect(policy.OutlierDetection.ConsecutiveErrors).To(Equal(int32(3)))
+	g.Expect(policy.PortLevelSettings[0].ConnectionPool.Tcp.MaxConnections).To(Equal(int32(10)))
+	g.Expect(policy.PortLevelSettings[0].Tls.Mode).To(Equal(v1alpha3.TLSSettings_MUTUAL))
+	g.Expect(otherRules).To(HaveLen(1))
+	g.Expect(otherRules[0].Subsets[0].TrafficPolicy.ConnectionPool).To(BeNil())
+}
+
+func TestBindingParametersOfAsynchronousBind(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := interceptorForBind(configStore)
+	request, err := interceptor.PreBind(bindRequestWithParameters(`{"istio": {"port": 5432}}`))
+	g.Expect(err).NotTo(HaveOccurred())
+	err = interceptor.(asyncBindInterceptor).PostBindAccepted(*request, "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	binding, err := interceptorForBind(configStore).PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 5432}}))
+}
+
+func TestRetriedBindWithOtherBindingParametersConflicts(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	_, err := interceptorForBind(configStore).PostBind(bindRequestWithParameters(`{"istio": {"port": 5432}}`),
+		bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	_, err = interceptorForBind(configStore).PostBind(bindRequestWithParameters(`{}`),
+		bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(*model.HttpError).StatusCode).To(Equal(http.StatusConflict))
+}
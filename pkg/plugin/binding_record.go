@@ -0,0 +1,205 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/config"
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	bindingRecordPrefix = "istio-binding-"
+	bindingRecordKey    = "binding.json"
+)
+
+// BindingRecord lists the kubernetes services and istio configs created for a binding,
+// so that unbind removes exactly these objects. The record itself is kept in the namespace of the plugin,
+// the objects in the target namespace of the binding, where empty means the namespace of the plugin.
+type BindingRecord struct {
+	BindingId string          `json:"binding_id"`
+	Metadata  BindingMetadata `json:"metadata"`
+	Namespace string          `json:"namespace,omitempty"`
+	// Fingerprint of the bind parameters, to tell a retried bind from a conflicting one
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Parameters of the binding, as chosen by the platform
+	Parameters   BindingParameters `json:"parameters"`
+	Services     []string          `json:"services"`
+	IstioConfigs []IstioConfigRef  `json:"istio_configs"`
+	// PendingCleanup is set once the binding is unbound or its bind failed. The record then only lists the objects
+	// that could not be removed yet, which the reconciler removes.
+	PendingCleanup bool `json:"pending_cleanup,omitempty"`
+	// Created is the creation time of the record as reported by kubernetes, it is not stored in the record
+	Created time.Time `json:"-"`
+}
+
+type IstioConfigRef struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+func (r *BindingRecord) addService(serviceName string) {
+	r.Services = append(r.Services, serviceName)
+	for _, id := range config.DeleteEntriesForExternalServiceClient(serviceName) {
+		r.IstioConfigs = append(r.IstioConfigs, IstioConfigRef{Type: id.Type, Name: id.Name})
+	}
+}
+
+func (r *BindingRecord) addServices(count int) {
+	for index := 0; index < count; index++ {
+		r.addService(serviceName(index, r.BindingId))
+	}
+}
+
+func (r *BindingRecord) isEmpty() bool {
+	return len(r.Services) == 0 && len(r.IstioConfigs) == 0
+}
+
+func (r BindingRecord) String() string {
+	var names []string
+	for _, ref := range r.IstioConfigs {
+		names = append(names, ref.Type+":"+ref.Name)
+	}
+	for _, service := range r.Services {
+		names = append(names, "Service:"+service)
+	}
+	return strings.Join(names, ", ")
+}
+
+// bindingFingerprint hashes the instance, service, plan, parameters and target namespace of a bind. The binding
+// parameters are only part of the hash if set, so that the fingerprints of earlier binds stay valid.
+func bindingFingerprint(request model.BindRequest, metadata BindingMetadata, bindingParameters BindingParameters, namespace string) string {
+	var parameters interface{}
+	if raw, ok := request.AdditionalProperties["parameters"]; ok {
+		json.Unmarshal(raw, &parameters)
+	}
+	values := map[string]interface{}{
+		"instance_id": metadata.InstanceId,
+		"service_id":  metadata.ServiceId,
+		"plan_id":     metadata.PlanId,
+		"parameters":  parameters,
+		"namespace":   namespace,
+	}
+	if bindingParameters.isSet() {
+		values[bindingParametersKey] = bindingParameters
+	}
+	data, _ := json.Marshal(values)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func bindingRecordName(bindId string) string {
+	return subdomainName(bindingRecordPrefix, bindId)
+}
+
+func marshalBindingRecord(record BindingRecord) (map[string]string, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{bindingRecordKey: string(data)}, nil
+}
+
+func unmarshalBindingRecord(configMap *v1.ConfigMap) (*BindingRecord, error) {
+	var record BindingRecord
+	err := json.Unmarshal([]byte(configMap.Data[bindingRecordKey]), &record)
+	if err != nil {
+		return nil, fmt.Errorf("Can't unmarshal binding record: %s", err.Error())
+	}
+	record.Created = configMap.CreationTimestamp.Time
+	return &record, nil
+}
+
+// createdObjects collects the objects a bind created, or found created for the same binding before, so that a
+// failed bind removes only these and not objects of other bindings with the same names
+type createdObjects struct {
+	mutex   sync.Mutex
+	created BindingRecord
+}
+
+func newCreatedObjects(record BindingRecord) *createdObjects {
+	return &createdObjects{created: BindingRecord{BindingId: record.BindingId, Metadata: record.Metadata, Namespace: record.Namespace}}
+}
+
+func (o *createdObjects) addService(name string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.created.Services = append(o.created.Services, name)
+}
+
+func (o *createdObjects) addIstioConfig(configType string, name string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.created.IstioConfigs = append(o.created.IstioConfigs, IstioConfigRef{Type: configType, Name: name})
+}
+
+// record returns a record of the collected objects
+func (o *createdObjects) record() BindingRecord {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.created
+}
+
+// removeBindingObjects deletes all objects of the record. Objects that are already gone count as removed.
+// The returned record contains the objects that could not be removed.
+func removeBindingObjects(configStore ConfigStore, record BindingRecord) (BindingRecord, error) {
+	remaining := BindingRecord{BindingId: record.BindingId, Metadata: record.Metadata, Namespace: record.Namespace,
+		PendingCleanup: true}
+	var lastErr error
+	for _, ref := range record.IstioConfigs {
+		err := configStore.DeleteIstioConfig(ref.Type, ref.Name)
+		if err != nil && !errors.IsNotFound(err) {
+			remaining.IstioConfigs = append(remaining.IstioConfigs, ref)
+			lastErr = err
+		}
+	}
+	for _, service := range record.Services {
+		err := configStore.DeleteService(service)
+		if err != nil && !errors.IsNotFound(err) {
+			remaining.Services = append(remaining.Services, service)
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return remaining, fmt.Errorf("Could not remove objects of binding %s (%s): %s", record.BindingId, remaining, lastErr.Error())
+	}
+	return remaining, nil
+}
+
+// findBindingObjects returns a record of the objects labeled with the binding id. As the label may be a hash of the
+// binding id, objects annotated with another binding id are skipped.
+func findBindingObjects(configStore ConfigStore, bindId string) (BindingRecord, error) {
+	record := BindingRecord{BindingId: bindId, Namespace: configStore.Namespace()}
+	ofBinding := func(annotations map[string]string) bool {
+		id, ok := annotations[bindingIdKey]
+		return !ok || id == bindId
+	}
+	services, err := configStore.ListServices(BindingSelector(bindId))
+	if err != nil {
+		return record, err
+	}
+	for _, service := range services {
+		if ofBinding(service.Annotations) {
+			record.Services = append(record.Services, service.Name)
+		}
+	}
+	for _, configType := range istioConfigTypes {
+		configs, err := configStore.ListIstioConfigs(configType, BindingSelector(bindId))
+		if err != nil {
+			return record, err
+		}
+		for _, config := range configs {
+			if ofBinding(config.Annotations) {
+				record.IstioConfigs = append(record.IstioConfigs, IstioConfigRef{Type: config.Type, Name: config.Name})
+			}
+		}
+	}
+	return record, nil
+}
@@ -0,0 +1,268 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"istio.io/istio/pilot/pkg/config/kube/crd"
+	"istio.io/istio/pilot/pkg/model"
+	coordination "k8s.io/api/coordination/v1beta1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var istioConfigTypes = []string{model.ServiceEntry.Type, model.VirtualService.Type, model.Gateway.Type, model.DestinationRule.Type}
+
+type ConfigStore interface {
+	CreateService(*v1.Service) (*v1.Service, error)
+	GetService(string) (*v1.Service, error)
+	CreateIstioConfig(model.Config) error
+	GetIstioConfig(string, string) (*model.Config, error)
+	DeleteService(string) error
+	DeleteIstioConfig(string, string) error
+	ListServices(labels.Selector) ([]v1.Service, error)
+	ListIstioConfigs(string, labels.Selector) ([]model.Config, error)
+	SaveBindingRecord(BindingRecord) error
+	GetBindingRecord(string) (*BindingRecord, error)
+	ListBindingRecords() ([]BindingRecord, error)
+	DeleteBindingRecord(string) error
+	Namespace() string
+	// InNamespace returns a store for the services and istio configs of another namespace
+	InNamespace(string) ConfigStore
+}
+
+// NewConfigStore connects to the cluster the plugin runs in. Outside of a cluster it connects to the cluster
+// of the KUBECONFIG file and uses the given namespace. Istio configs refer to services of the given cluster domain.
+func NewConfigStore(namespace string, clusterDomain string) (ConfigStore, error) {
+	configStore, err := NewInClusterConfigStore(clusterDomain)
+	if err == nil {
+		return configStore, nil
+	}
+	if os.Getenv("KUBECONFIG") == "" {
+		return nil, fmt.Errorf("Not running in a kubernetes cluster and KUBECONFIG not set: %s", err.Error())
+	}
+	loggerFor(context.Background()).Infof("Not running in a kubernetes cluster, using KUBECONFIG %s", os.Getenv("KUBECONFIG"))
+	if namespace == "" {
+		return nil, fmt.Errorf("namespace must be configured when running outside of a kubernetes cluster")
+	}
+	return NewExternKubeConfigStore(namespace, clusterDomain)
+}
+
+func NewInClusterConfigStore(clusterDomain string) (ConfigStore, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := getNamespace()
+	if err != nil {
+		return nil, err
+	}
+	return newKubeConfigStore(cfg, namespace, clusterDomain)
+}
+
+func NewExternKubeConfigStore(namespace string, clusterDomain string) (ConfigStore, error) {
+	clientcmd.ClusterDefaults.Server = ""
+	cfg, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+	if err != nil {
+		return nil, fmt.Errorf("Can't load KUBECONFIG %s: %s", os.Getenv("KUBECONFIG"), err.Error())
+	}
+	return newKubeConfigStore(cfg, namespace, clusterDomain)
+}
+
+func newKubeConfigStore(config *rest.Config, namespace string, clusterDomain string) (ConfigStore, error) {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	kubeCfgFile := os.Getenv("KUBECONFIG")
+	configClient, err := crd.NewClient(kubeCfgFile, "", model.IstioConfigTypes, clusterDomain)
+	if err != nil {
+		return nil, err
+	}
+
+	return kubeConfigStore{clientset, namespace, configClient}, nil
+}
+
+func getNamespace() (string, error) {
+	file, err := os.Open("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	namespace := strings.TrimSpace(string(content))
+	loggerFor(context.Background()).Infof("Using namespace %s", namespace)
+	return namespace, nil
+}
+
+type kubeConfigStore struct {
+	*kubernetes.Clientset
+	namespace    string
+	configClient *crd.Client
+}
+
+func (k kubeConfigStore) Namespace() string {
+	return k.namespace
+}
+
+func (k kubeConfigStore) InNamespace(namespace string) ConfigStore {
+	k.namespace = namespace
+	return k
+}
+
+func (k kubeConfigStore) CreateService(service *v1.Service) (*v1.Service, error) {
+	return k.CoreV1().Services(k.namespace).Create(service)
+}
+
+func (k kubeConfigStore) GetService(serviceName string) (*v1.Service, error) {
+	return k.CoreV1().Services(k.namespace).Get(serviceName, meta_v1.GetOptions{})
+}
+
+func (k kubeConfigStore) CreateIstioConfig(cfg model.Config) error {
+	_, err := k.configClient.Create(cfg)
+	return err
+}
+
+func (k kubeConfigStore) GetIstioConfig(configType string, configName string) (*model.Config, error) {
+	configs, err := k.configClient.List(configType, k.namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, config := range configs {
+		if config.Name == configName {
+			return &config, nil
+		}
+	}
+	return nil, errors.NewNotFound(schema.GroupResource{Group: "networking.istio.io", Resource: configType}, configName)
+}
+
+func (k kubeConfigStore) DeleteService(serviceName string) error {
+	loggerFor(context.Background()).Debugf("kubectl -n %s delete services %s", k.namespace, serviceName)
+	return k.CoreV1().Services(k.namespace).Delete(serviceName, &meta_v1.DeleteOptions{})
+}
+
+func (k kubeConfigStore) DeleteIstioConfig(configType string, configName string) error {
+	loggerFor(context.Background()).Debugf("kubectl -n %s delete %s %s", k.namespace, configType, configName)
+	return k.configClient.Delete(configType, configName, k.namespace)
+}
+
+func (k kubeConfigStore) ListServices(selector labels.Selector) ([]v1.Service, error) {
+	services, err := k.CoreV1().Services(k.namespace).List(meta_v1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	return services.Items, nil
+}
+
+func (k kubeConfigStore) ListIstioConfigs(configType string, selector labels.Selector) ([]model.Config, error) {
+	configs, err := k.configClient.List(configType, k.namespace)
+	if err != nil {
+		return nil, err
+	}
+	var result []model.Config
+	for _, config := range configs {
+		if selector.Matches(labels.Set(config.Labels)) {
+			result = append(result, config)
+		}
+	}
+	return result, nil
+}
+
+// probeServices lists at most one service of the namespace to check the access to the kubernetes API
+func (k kubeConfigStore) probeServices(namespace string) error {
+	_, err := k.CoreV1().Services(namespace).List(meta_v1.ListOptions{Limit: 1})
+	return err
+}
+
+// probeIstioConfigType checks with the discovery API that the resource of the istio config type is served
+func (k kubeConfigStore) probeIstioConfigType(configType string) error {
+	configSchema, ok := model.IstioConfigTypes.GetByType(configType)
+	if !ok {
+		return fmt.Errorf("Unknown istio config type %s", configType)
+	}
+	resources, err := k.Discovery().ServerResourcesForGroupVersion(crd.ResourceGroup(&configSchema) + "/" + configSchema.Version)
+	if err != nil {
+		return err
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == crd.ResourceName(configSchema.Plural) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Resource %s is not served by the API server", crd.ResourceName(configSchema.Plural))
+}
+
+func (k kubeConfigStore) SaveBindingRecord(record BindingRecord) error {
+	data, err := marshalBindingRecord(record)
+	if err != nil {
+		return err
+	}
+	configMap := &v1.ConfigMap{Data: data}
+	configMap.Name = bindingRecordName(record.BindingId)
+	configMap.Labels = record.Metadata.Labels()
+	configMap.Annotations = record.Metadata.Annotations()
+	_, err = k.CoreV1().ConfigMaps(k.namespace).Update(configMap)
+	if errors.IsNotFound(err) {
+		_, err = k.CoreV1().ConfigMaps(k.namespace).Create(configMap)
+	}
+	return err
+}
+
+func (k kubeConfigStore) GetBindingRecord(bindId string) (*BindingRecord, error) {
+	configMap, err := k.CoreV1().ConfigMaps(k.namespace).Get(bindingRecordName(bindId), meta_v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalBindingRecord(configMap)
+}
+
+func (k kubeConfigStore) ListBindingRecords() ([]BindingRecord, error) {
+	configMaps, err := k.CoreV1().ConfigMaps(k.namespace).List(meta_v1.ListOptions{LabelSelector: ManagedSelector().String()})
+	if err != nil {
+		return nil, err
+	}
+	var records []BindingRecord
+	for _, configMap := range configMaps.Items {
+		if _, ok := configMap.Data[bindingRecordKey]; !ok {
+			continue
+		}
+		record, err := unmarshalBindingRecord(&configMap)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *record)
+	}
+	return records, nil
+}
+
+func (k kubeConfigStore) DeleteBindingRecord(bindId string) error {
+	loggerFor(context.Background()).Debugf("kubectl -n %s delete configmaps %s", k.namespace, bindingRecordName(bindId))
+	return k.CoreV1().ConfigMaps(k.namespace).Delete(bindingRecordName(bindId), &meta_v1.DeleteOptions{})
+}
+
+func (k kubeConfigStore) GetLease(name string) (*coordination.Lease, error) {
+	return k.CoordinationV1beta1().Leases(k.namespace).Get(name, meta_v1.GetOptions{})
+}
+
+func (k kubeConfigStore) CreateLease(lease *coordination.Lease) (*coordination.Lease, error) {
+	return k.CoordinationV1beta1().Leases(k.namespace).Create(lease)
+}
+
+func (k kubeConfigStore) UpdateLease(lease *coordination.Lease) (*coordination.Lease, error) {
+	return k.CoordinationV1beta1().Leases(k.namespace).Update(lease)
+}
+
+func (k kubeConfigStore) DeleteLease(name string) error {
+	return k.CoordinationV1beta1().Leases(k.namespace).Delete(name, &meta_v1.DeleteOptions{})
+}
@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+const kubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: kind
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: kind
+  context:
+    cluster: kind
+    user: kind
+current-context: kind
+users:
+- name: kind
+  user:
+    token: secret
+`
+
+func withKubeconfig(g *GomegaWithT, content string) func() {
+	dir, err := ioutil.TempDir("", "istio-plugin")
+	g.Expect(err).NotTo(HaveOccurred())
+	file := filepath.Join(dir, "kubeconfig")
+	g.Expect(ioutil.WriteFile(file, []byte(content), 0600)).To(Succeed())
+	os.Setenv("KUBECONFIG", file)
+	return func() {
+		os.Unsetenv("KUBECONFIG")
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewConfigStoreOutsideOfClusterWithoutKubeconfig(t *testing.T) {
+	g := NewGomegaWithT(t)
+	os.Unsetenv("KUBECONFIG")
+
+	_, err := NewConfigStore("catalog", "cluster.local")
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("KUBECONFIG not set"))
+}
+
+func TestNewConfigStoreWithKubeconfig(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer withKubeconfig(g, kubeconfig)()
+
+	configStore, err := NewConfigStore("catalog", "cluster.local")
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.Namespace()).To(Equal("catalog"))
+}
+
+func TestNewConfigStoreWithKubeconfigRequiresNamespace(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer withKubeconfig(g, kubeconfig)()
+
+	_, err := NewConfigStore("", "cluster.local")
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("namespace"))
+}
+
+func TestNewConfigStoreWithInvalidKubeconfig(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer withKubeconfig(g, "clusters: [")()
+
+	_, err := NewConfigStore("catalog", "cluster.local")
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("KUBECONFIG"))
+}
@@ -0,0 +1,577 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/config"
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"github.com/Peripli/istio-broker-proxy/pkg/router"
+	"github.com/Peripli/service-manager/pkg/web"
+	"github.com/sirupsen/logrus"
+	"istio.io/api/networking/v1alpha3"
+	istioModel "istio.io/istio/pilot/pkg/model"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+type ConsumerInterceptor struct {
+	ConsumerId        string
+	ConfigStore       ConfigStore
+	ServiceNamePrefix string
+	NetworkProfile    string
+	NetworkProfiles   *NetworkProfiles
+	// TargetNamespace of the services and istio configs, if not the namespace of the plugin
+	TargetNamespace string
+	// TargetNamespaceTemplate derives the target namespace per binding, see NewNamespaceTemplate
+	TargetNamespaceTemplate *template.Template
+	// Parallelism is the maximum number of objects of a binding that are created at the same time
+	Parallelism int
+	// Topology of the service mesh, values that are not set are taken from DefaultMeshTopology
+	Topology MeshTopology
+	scope    BindingMetadata
+	brokerId string
+	// parameters are the binding parameters PreBind took from the bind request
+	parameters    *BindingParameters
+	requestLogger *logrus.Entry
+}
+
+// ForRequest returns a copy of the interceptor that knows the instance, service and plan of the OSB request
+// and stops retrying kubernetes operations when the request is cancelled
+func (c ConsumerInterceptor) ForRequest(request *web.Request, ids RequestIds) router.ServiceBrokerInterceptor {
+	query := request.URL.Query()
+	c.scope = BindingMetadata{
+		InstanceId: ids.InstanceId,
+		ServiceId:  query.Get("service_id"),
+		PlanId:     query.Get("plan_id")}
+	c.brokerId = ids.BrokerId
+	c.parameters = &BindingParameters{}
+	c.requestLogger = loggerFor(request.Context())
+	if configStore, ok := c.ConfigStore.(retryingConfigStore); ok {
+		c.ConfigStore = configStore.forContext(request.Context())
+	}
+	return c
+}
+
+func (c ConsumerInterceptor) logger() *logrus.Entry {
+	if c.requestLogger == nil {
+		return loggerFor(context.Background())
+	}
+	return c.requestLogger
+}
+
+// bindingMetadata returns the metadata of the binding, including its network profile,
+// and false if the binding bypasses the service mesh
+func (c ConsumerInterceptor) bindingMetadata(request model.BindRequest, bindId string) (BindingMetadata, bool) {
+	metadata := c.scope
+	metadata.BindingId = bindId
+	metadata.ConsumerId = c.ConsumerId
+	if serviceId := additionalString(request.AdditionalProperties, "service_id"); serviceId != "" {
+		metadata.ServiceId = serviceId
+	}
+	if planId := additionalString(request.AdditionalProperties, "plan_id"); planId != "" {
+		metadata.PlanId = planId
+	}
+	metadata.NetworkProfile = c.NetworkProfile
+	if c.NetworkProfiles != nil {
+		if rule, ok := c.NetworkProfiles.Select(c.brokerId, metadata.ServiceId, metadata.PlanId); ok {
+			metadata.NetworkProfile = rule.NetworkProfile
+			return metadata, !rule.Disabled
+		}
+	}
+	return metadata, true
+}
+
+// bindingParameters returns the binding parameters of the bind request and the request without them.
+// If PreBind already took them from the request, these are returned.
+func (c ConsumerInterceptor) bindingParameters(request model.BindRequest) (BindingParameters, model.BindRequest, error) {
+	parameters, request, found, err := takeBindingParameters(request)
+	if err != nil || found || c.parameters == nil {
+		return parameters, request, err
+	}
+	return *c.parameters, request, nil
+}
+
+func (c ConsumerInterceptor) PreBind(request model.BindRequest) (*model.BindRequest, error) {
+	parameters, request, _, err := takeBindingParameters(request)
+	if err != nil {
+		return nil, err
+	}
+	if c.parameters != nil {
+		*c.parameters = parameters
+	}
+	metadata, enabled := c.bindingMetadata(request, "")
+	if !enabled {
+		c.logger().Infof("Service mesh disabled for service %s and plan %s", metadata.ServiceId, metadata.PlanId)
+		return &request, nil
+	}
+	if parameters.Disabled {
+		c.logger().Info("Service mesh disabled by the bind parameters")
+		return &request, nil
+	}
+	if metadata.NetworkProfile == "" {
+		return nil, fmt.Errorf("network profile not configured")
+	}
+	if _, err := c.targetNamespace(request, metadata); err != nil {
+		return nil, err
+	}
+	request.NetworkData.Data.ConsumerId = c.ConsumerId
+	request.NetworkData.NetworkProfileId = metadata.NetworkProfile
+	return &request, nil
+}
+
+func (c ConsumerInterceptor) PostBind(request model.BindRequest, response model.BindResponse, bindId string,
+	adapt func(model.Credentials, []model.EndpointMapping) (*model.BindResponse, error)) (*model.BindResponse, error) {
+	var endpointMapping []model.EndpointMapping
+
+	parameters, request, err := c.bindingParameters(request)
+	if err != nil {
+		return nil, err
+	}
+	metadata, enabled := c.bindingMetadata(request, bindId)
+	if !enabled || parameters.Disabled || metadata.NetworkProfile != response.NetworkData.NetworkProfileId {
+		c.logger().Infof("Ignoring bind request for network id: %s", response.NetworkData.NetworkProfileId)
+		return &response, nil
+	}
+
+	err = validateBindResponse(response)
+	if err != nil {
+		return nil, err
+	}
+
+	record, retried, err := c.bindingRecord(request, response, bindId, metadata, parameters)
+	if err != nil {
+		return nil, err
+	}
+	if record.Parameters.Disabled {
+		c.logger().Infof("Service mesh disabled by the bind parameters of binding %s", bindId)
+		return &response, nil
+	}
+	if retried {
+		c.logger().Infof("Reusing istio objects of binding %s", bindId)
+	} else {
+		err = c.ConfigStore.SaveBindingRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("Can't record objects of binding %s: %s", bindId, err.Error())
+		}
+	}
+
+	trafficPolicy, err := record.Parameters.trafficPolicy()
+	if err != nil {
+		return nil, invalidParametersError(err)
+	}
+	c.logger().Debugf("Number of endpoints: %d", len(response.NetworkData.Data.Endpoints))
+	targets := make([]model.Endpoint, len(response.NetworkData.Data.Endpoints))
+	created := newCreatedObjects(record)
+	group := newBoundedGroup(c.Parallelism)
+	for index, endpoint := range response.NetworkData.Data.Endpoints {
+		c.logger().Infof("Creating istio objects for %s", record.Services[index])
+		createIstioObjects(group, c.objectStore(record.Namespace), record.Services[index], endpoint,
+			c.servicePort(record.Parameters, response.Endpoints[index]), response.NetworkData.Data.ProviderId, record.Metadata,
+			trafficPolicy, c.Topology.withDefaults(), &targets[index], created)
+	}
+	err = group.Wait()
+	if err != nil {
+		c.logger().Errorf("Can't create istio objects of binding %s: %s", bindId, err.Error())
+		if !retried {
+			c.removeBinding(created.record())
+		}
+		return nil, err
+	}
+	for index, target := range targets {
+		endpointMapping = append(endpointMapping,
+			model.EndpointMapping{
+				Source: response.Endpoints[index],
+				Target: target})
+	}
+	binding, err := adaptBinding(response, endpointMapping, adapt)
+	if err != nil {
+		if !retried {
+			c.removeBinding(created.record())
+		}
+		return nil, err
+	}
+	return binding, nil
+}
+
+// bindingRecord returns the record of the objects to create for the binding and true if the objects were already
+// created by an earlier bind with the same parameters, which is then retried. If the earlier bind had different
+// parameters, a conflict is returned.
+func (c ConsumerInterceptor) bindingRecord(request model.BindRequest, response model.BindResponse, bindId string,
+	metadata BindingMetadata, parameters BindingParameters) (BindingRecord, bool, error) {
+	existing, err := c.ConfigStore.GetBindingRecord(bindId)
+	if err != nil && !errors.IsNotFound(err) {
+		return BindingRecord{}, false, fmt.Errorf("Can't read record of binding %s: %s", bindId, err.Error())
+	}
+	if err == nil && existing.PendingCleanup {
+		return BindingRecord{}, false, conflictError("Objects of an earlier binding %s are still being removed", bindId)
+	}
+	if err == nil && isPolledBind(request) {
+		if existing.isEmpty() {
+			record := BindingRecord{BindingId: bindId, Metadata: existing.Metadata, Namespace: existing.Namespace,
+				Fingerprint: existing.Fingerprint, Parameters: existing.Parameters}
+			record.addServices(len(response.NetworkData.Data.Endpoints))
+			return record, false, nil
+		}
+		return *existing, true, validateRetriedBind(*existing, response)
+	}
+
+	namespace, err := c.targetNamespace(request, metadata)
+	if err != nil {
+		return BindingRecord{}, false, err
+	}
+	record := BindingRecord{BindingId: bindId, Metadata: metadata, Namespace: namespace,
+		Fingerprint: bindingFingerprint(request, metadata, parameters, namespace), Parameters: parameters}
+	if existing != nil && !existing.isEmpty() {
+		if existing.Fingerprint != "" && existing.Fingerprint != record.Fingerprint {
+			return BindingRecord{}, false, conflictError("Binding %s already exists with different parameters", bindId)
+		}
+		return *existing, true, validateRetriedBind(*existing, response)
+	}
+	record.addServices(len(response.NetworkData.Data.Endpoints))
+	return record, false, nil
+}
+
+// isPolledBind returns true for the PostBind of an asynchronous bind, which has no bind request anymore
+func isPolledBind(request model.BindRequest) bool {
+	return request.NetworkData.NetworkProfileId == "" && len(request.AdditionalProperties) == 0
+}
+
+func validateRetriedBind(existing BindingRecord, response model.BindResponse) error {
+	if len(existing.Services) != len(response.NetworkData.Data.Endpoints) {
+		return conflictError("Binding %s already exists with %d instead of %d endpoints",
+			existing.BindingId, len(existing.Services), len(response.NetworkData.Data.Endpoints))
+	}
+	return nil
+}
+
+func conflictError(format string, args ...interface{}) error {
+	return &model.HttpError{ErrorMsg: fmt.Sprintf(format, args...), StatusCode: http.StatusConflict}
+}
+
+// PostBindAccepted records the metadata, target namespace and binding parameters of an asynchronous bind,
+// as the bind request is not available anymore when the binding succeeded
+func (c ConsumerInterceptor) PostBindAccepted(request model.BindRequest, bindId string) error {
+	parameters, request, err := c.bindingParameters(request)
+	if err != nil {
+		return err
+	}
+	metadata, enabled := c.bindingMetadata(request, bindId)
+	if !enabled {
+		return nil
+	}
+	namespace, err := c.targetNamespace(request, metadata)
+	if err != nil {
+		return err
+	}
+	return c.ConfigStore.SaveBindingRecord(BindingRecord{BindingId: bindId, Metadata: metadata, Namespace: namespace,
+		Fingerprint: bindingFingerprint(request, metadata, parameters, namespace), Parameters: parameters})
+}
+
+// IsBindPending returns true if PostBindAccepted recorded the binding and its objects are not created yet
+func (c ConsumerInterceptor) IsBindPending(bindId string) (bool, error) {
+	record, err := c.ConfigStore.GetBindingRecord(bindId)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !record.PendingCleanup && record.isEmpty(), nil
+}
+
+// PostFetchBinding maps the endpoints of a binding fetched from the broker to the services created during bind,
+// so that the platform receives the same credentials as in the original bind response.
+func (c ConsumerInterceptor) PostFetchBinding(response model.BindResponse, bindId string,
+	adapt func(model.Credentials, []model.EndpointMapping) (*model.BindResponse, error)) (*model.BindResponse, error) {
+	var endpointMapping []model.EndpointMapping
+
+	if !c.matchesNetworkProfile(response) {
+		c.logger().Infof("Ignoring fetched binding for network id: %s", response.NetworkData.NetworkProfileId)
+		return &response, nil
+	}
+
+	// bindings created before the validation of bind responses must stay readable, only the endpoints are required
+	if err := validateBindResponse(response); err != nil {
+		if len(response.NetworkData.Data.Endpoints) != len(response.Endpoints) {
+			return nil, err
+		}
+		c.logger().Warnf("Fetched binding %s is not a valid bind response: %s", bindId, err.Error())
+	}
+
+	var objects ConfigStore
+	var services []string
+	if record, err := c.ConfigStore.GetBindingRecord(bindId); err == nil {
+		objects = c.objectStore(record.Namespace)
+		services = record.Services
+	} else {
+		objects = c.fallbackObjectStore(bindId)
+	}
+	for index := range response.NetworkData.Data.Endpoints {
+		name := serviceName(index, bindId)
+		if index < len(services) {
+			name = services[index]
+		}
+		service, err := objects.GetService(name)
+		if err != nil {
+			return nil, fmt.Errorf("Service for endpoint %d of binding %s not found: %s", index, bindId, err.Error())
+		}
+		endpointMapping = append(endpointMapping,
+			model.EndpointMapping{
+				Source: response.Endpoints[index],
+				Target: serviceEndpoint(service, objects.Namespace(), c.Topology.withDefaults())})
+	}
+	return adaptBinding(response, endpointMapping, adapt)
+}
+
+// fallbackObjectStore returns the store of the first fallback namespace with the first service of a binding
+// without record
+func (c ConsumerInterceptor) fallbackObjectStore(bindId string) ConfigStore {
+	metadata, _ := c.bindingMetadata(model.BindRequest{}, bindId)
+	for _, namespace := range c.fallbackNamespaces(metadata) {
+		objects := c.objectStore(namespace)
+		if _, err := objects.GetService(serviceName(0, bindId)); err == nil {
+			return objects
+		}
+	}
+	return c.ConfigStore
+}
+
+// matchesNetworkProfile returns true if the binding was created with one of the network profiles of the plugin
+func (c ConsumerInterceptor) matchesNetworkProfile(response model.BindResponse) bool {
+	profile := response.NetworkData.NetworkProfileId
+	if profile == c.NetworkProfile {
+		return true
+	}
+	return profile != "" && c.NetworkProfiles != nil && c.NetworkProfiles.IsKnown(profile)
+}
+
+func adaptBinding(response model.BindResponse, endpointMapping []model.EndpointMapping,
+	adapt func(model.Credentials, []model.EndpointMapping) (*model.BindResponse, error)) (*model.BindResponse, error) {
+	binding, err := adapt(response.Credentials, endpointMapping)
+	if err != nil {
+		return nil, err
+	}
+	binding.NetworkData = response.NetworkData
+	binding.AdditionalProperties = response.AdditionalProperties
+	return binding, nil
+}
+
+// servicePort returns the port of the local service for the endpoint of the provider: the port chosen in the binding
+// parameters, the port of the provider if it is preserved, or the service port of the topology
+func (c ConsumerInterceptor) servicePort(parameters BindingParameters, provider model.Endpoint) int32 {
+	topology := c.Topology.withDefaults()
+	if parameters.Port != 0 {
+		return parameters.Port
+	}
+	if topology.PreserveProviderPort {
+		return int32(provider.Port)
+	}
+	return topology.ServicePort
+}
+
+// createIstioObjects adds the creation of the service with the given port to the group and, once it got its
+// cluster ip, the creation of its istio configs. The cluster ip and port of the service are stored in target,
+// the objects that belong to the binding are added to created.
+func createIstioObjects(group *boundedGroup, configStore ConfigStore, name string, endpoint model.Endpoint, port int32, systemDomain string,
+	metadata BindingMetadata, trafficPolicy *v1alpha3.TrafficPolicy, topology MeshTopology, target *model.Endpoint, created *createdObjects) {
+	labels := metadata.Labels()
+	annotations := metadata.Annotations()
+	group.Go(func() error {
+		service := &v1.Service{Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: port, TargetPort: intstr.FromInt(int(port))}}}}
+		service.Name = name
+		service.Labels = labels
+		service.Annotations = annotations
+		service, err := createOrReuseService(configStore, service, metadata.BindingId)
+		if err != nil {
+			return objectError("service", name, err)
+		}
+		created.addService(service.Name)
+		*target = serviceEndpoint(service, configStore.Namespace(), topology)
+		configurations := config.CreateEntriesForExternalServiceClient(service.Name, endpoint.Host, service.Spec.ClusterIP, topology.EgressPort,
+			configStore.Namespace(), systemDomain)
+		for _, configuration := range configurations {
+			configuration := configuration
+			configuration.Labels = mergeInto(configuration.Labels, labels)
+			configuration.Annotations = mergeInto(configuration.Annotations, annotations)
+			topology.apply(configuration, serviceHost(service.Name, configStore.Namespace(), topology.ClusterDomain))
+			applyTrafficPolicy(configuration, endpoint.Host, trafficPolicy)
+			group.Go(func() error {
+				err := createOrReuseIstioConfig(configStore, configuration, metadata.BindingId)
+				if err != nil {
+					return objectError(configuration.Type, configuration.Name, err)
+				}
+				created.addIstioConfig(configuration.Type, configuration.Name)
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// objectError names the object that could not be created. Errors with an HTTP status are kept as they are.
+func objectError(objectType string, name string, err error) error {
+	if _, ok := err.(*model.HttpError); ok {
+		return err
+	}
+	return fmt.Errorf("Can't create %s %s: %s", objectType, name, err.Error())
+}
+
+// createOrReuseService creates the service or returns the existing one, if it was created for the same binding before
+func createOrReuseService(configStore ConfigStore, service *v1.Service, bindId string) (*v1.Service, error) {
+	created, err := configStore.CreateService(service)
+	if !errors.IsAlreadyExists(err) {
+		return created, err
+	}
+	existing, err := configStore.GetService(service.Name)
+	if err != nil {
+		return nil, err
+	}
+	if existing.Annotations[bindingIdKey] != bindId {
+		return nil, conflictError("Service %s already exists for binding %s", service.Name, existing.Annotations[bindingIdKey])
+	}
+	return existing, nil
+}
+
+// createOrReuseIstioConfig creates the istio config unless it was created for the same binding before
+func createOrReuseIstioConfig(configStore ConfigStore, configuration istioModel.Config, bindId string) error {
+	err := configStore.CreateIstioConfig(configuration)
+	if !errors.IsAlreadyExists(err) {
+		return err
+	}
+	existing, err := configStore.GetIstioConfig(configuration.Type, configuration.Name)
+	if err != nil {
+		return err
+	}
+	if existing.Annotations[bindingIdKey] != bindId {
+		return conflictError("%s %s already exists for binding %s", configuration.Type, configuration.Name, existing.Annotations[bindingIdKey])
+	}
+	return nil
+}
+
+// serviceEndpoint returns the endpoint of the local service the applications connect to
+func serviceEndpoint(service *v1.Service, namespace string, topology MeshTopology) model.Endpoint {
+	endpoint := model.Endpoint{Host: service.Spec.ClusterIP, Port: int(topology.ServicePort)}
+	if len(service.Spec.Ports) != 0 {
+		endpoint.Port = int(service.Spec.Ports[0].Port)
+	}
+	if topology.ServiceFQDN {
+		endpoint.Host = serviceHost(service.Name, namespace, topology.ClusterDomain)
+	}
+	return endpoint
+}
+
+func (c ConsumerInterceptor) PostDelete(bindId string) error {
+	record, err := c.ConfigStore.GetBindingRecord(bindId)
+	if errors.IsNotFound(err) {
+		metadata, enabled := c.bindingMetadata(model.BindRequest{}, bindId)
+		if !enabled {
+			return nil
+		}
+		found := false
+		var lastErr error
+		for _, namespace := range c.fallbackNamespaces(metadata) {
+			record, err := findBindingObjects(c.objectStore(namespace), bindId)
+			if err == nil && !record.isEmpty() {
+				c.logger().Infof("No record found for binding %s, removing the objects labeled with its id in %s", bindId, namespace)
+				found = true
+				err = c.removeBinding(record)
+			}
+			if err != nil {
+				lastErr = err
+			}
+		}
+		if found || lastErr != nil {
+			return lastErr
+		}
+		// objects of older versions of the plugin have no binding labels and are in the namespace of the plugin
+		c.logger().Infof("No record found for binding %s, falling back to index based clean up", bindId)
+		return c.cleanUpConfig(bindId, func(index int, err error) bool {
+			return err != nil && index > 2
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return c.removeBinding(*record)
+}
+
+// removeBinding deletes the objects of the record and then the record itself. If some objects could not be
+// removed, the record is reduced to these objects and marked as pending clean up, so that a retried unbind or
+// the reconciler removes them.
+func (c ConsumerInterceptor) removeBinding(record BindingRecord) error {
+	remaining, err := removeBindingObjects(c.objectStore(record.Namespace), record)
+	if err != nil {
+		cleanupFailures.Inc()
+		c.logger().Error(err.Error())
+		if !remaining.isEmpty() {
+			if saveErr := c.ConfigStore.SaveBindingRecord(remaining); saveErr != nil {
+				c.logger().Errorf("Can't record remaining objects of binding %s: %s", record.BindingId, saveErr.Error())
+			}
+		}
+		return err
+	}
+	err = c.ConfigStore.DeleteBindingRecord(record.BindingId)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (c ConsumerInterceptor) cleanUpConfig(bindId string, endCleanupCondition func(index int, err error) bool) error {
+	i := 0
+	var err error
+
+	for {
+		isFirstIteration := i == 0
+		serviceNames := []string{serviceName(i, bindId)}
+		if legacyName := legacyServiceName(i, bindId); legacyName != serviceNames[0] {
+			serviceNames = append(serviceNames, legacyName)
+		}
+
+		for index, serviceName := range serviceNames {
+			for _, id := range config.DeleteEntriesForExternalServiceClient(serviceName) {
+				ignoredErr := c.ConfigStore.DeleteIstioConfig(id.Type, id.Name)
+				if ignoredErr != nil && isFirstIteration {
+					c.logger().Warnf("Ignoring error during removal of configuration %s: %s", id, ignoredErr.Error())
+				}
+			}
+			// the service counts as removed if it existed with any of its names
+			deleteErr := c.ConfigStore.DeleteService(serviceName)
+			if index == 0 || deleteErr == nil {
+				err = deleteErr
+			}
+		}
+		if endCleanupCondition(i, err) {
+			break
+		}
+		if err != nil && isFirstIteration {
+			if !errors.IsNotFound(err) {
+				cleanupFailures.Inc()
+			}
+			c.logger().Warnf("Ignoring error during removal of configuration %s: %s", serviceNames[0], err.Error())
+		}
+		i++
+	}
+	return nil
+}
+
+func (c ConsumerInterceptor) HasAdaptCredentials() bool {
+	return false
+}
+
+func (c ConsumerInterceptor) PostCatalog(catalog *model.Catalog) error {
+	if c.NetworkProfiles != nil {
+		if err := c.NetworkProfiles.learnCatalog(c.brokerId, catalog); err != nil {
+			c.logger().Warn(err.Error())
+		}
+	}
+	for i := range catalog.Services {
+		catalog.Services[i].Name = strings.TrimPrefix(catalog.Services[i].Name, c.ServiceNamePrefix)
+	}
+	return nil
+}
@@ -0,0 +1,606 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"github.com/Peripli/service-manager/pkg/web"
+	. "github.com/onsi/gomega"
+	istioModel "istio.io/istio/pilot/pkg/model"
+)
+
+var providerEndpoint = model.Endpoint{Host: "postgres.provider.example.com", Port: 47637}
+
+func bindResponseWithEndpoints(endpoints ...model.Endpoint) model.BindResponse {
+	return model.BindResponse{
+		Endpoints: endpoints,
+		NetworkData: model.NetworkDataResponse{
+			NetworkProfileId: "urn:local.test:public",
+			Data:             model.DataResponse{ProviderId: "provider", Endpoints: endpoints}}}
+}
+
+// createObjectsOfBinding creates the service with the given name and its istio configs for providerEndpoint, as
+// they were created by other bindings or older versions of the plugin
+func createObjectsOfBinding(configStore ConfigStore, name string, metadata BindingMetadata) error {
+	var target model.Endpoint
+	topology := DefaultMeshTopology()
+	group := newBoundedGroup(1)
+	createIstioObjects(group, configStore, name, providerEndpoint, topology.ServicePort, "provider", metadata, nil, topology, &target,
+		newCreatedObjects(BindingRecord{BindingId: metadata.BindingId, Metadata: metadata}))
+	return group.Wait()
+}
+
+func adaptEndpoints(credentials model.Credentials, mappings []model.EndpointMapping) (*model.BindResponse, error) {
+	return model.Adapt(credentials, mappings)
+}
+
+func TestConsumerInterceptorPreBind(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := ConsumerInterceptor{ConsumerId: "consumer", NetworkProfile: "urn:local.test:public"}
+
+	request, err := interceptor.PreBind(model.BindRequest{})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(request.NetworkData.Data.ConsumerId).To(Equal("consumer"))
+	g.Expect(request.NetworkData.NetworkProfileId).To(Equal("urn:local.test:public"))
+}
+
+func TestConsumerInterceptorPreBindWithoutNetworkProfile(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := ConsumerInterceptor{ConsumerId: "consumer"}
+
+	_, err := interceptor.PreBind(model.BindRequest{})
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(Equal("network profile not configured"))
+}
+
+func TestConsumerInterceptorPostBind(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+
+	binding, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 5555}}))
+	g.Expect(binding.NetworkData.Data.Endpoints).To(Equal([]model.Endpoint{providerEndpoint}))
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.CreatedServices[0].Name).To(Equal("svc-0-bind-id"))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(6))
+}
+
+func TestConsumerInterceptorPostBindIgnoresOtherNetworkProfiles(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:private"}
+
+	binding, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{providerEndpoint}))
+	g.Expect(configStore.CreatedServices).To(HaveLen(0))
+}
+
+func TestConsumerInterceptorPostBindCleansUpOnError(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{CreateObjectErr: errors.New("quota exceeded"), CreateObjectErrCount: 3}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(configStore.CreatedServices).To(HaveLen(0))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(0))
+	g.Expect(configStore.DeletedIstioConfigs).To(HaveLen(3))
+}
+
+func TestConsumerInterceptorPostDelete(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint, providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	err = interceptor.PostDelete("bind-id")
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.CreatedServices).To(HaveLen(0))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(0))
+	g.Expect(configStore.DeletedServices).To(ConsistOf("svc-0-bind-id", "svc-1-bind-id"))
+}
+
+func TestConsumerInterceptorPostBindLabelsObjects(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, ConsumerId: "consumer", NetworkProfile: "urn:local.test:public"}
+	request := web.Request{Request: &http.Request{URL: &url.URL{
+		Path:     "/v2/service_instances/instance-id/service_bindings/bind-id",
+		RawQuery: "service_id=query-service-id&plan_id=query-plan-id"}}}
+	bindRequest := model.BindRequest{AdditionalProperties: model.AdditionalProperties{"service_id": json.RawMessage(`"service-id"`)}}
+
+	_, err := interceptor.ForRequest(&request, requestIdsOf(&request)).PostBind(bindRequest, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	services, err := configStore.ListServices(BindingSelector("bind-id"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(services).To(HaveLen(1))
+	g.Expect(services[0].Labels).To(Equal(map[string]string{
+		managedByLabel:   managedByLabelValue,
+		bindingIdKey:     "bind-id",
+		instanceIdKey:    "instance-id",
+		serviceIdKey:     "service-id",
+		planIdKey:        "query-plan-id",
+		consumerIdKey:    "consumer",
+		pluginVersionKey: Version}))
+	g.Expect(services[0].Annotations).To(HaveKeyWithValue(networkProfileKey, "urn:local.test:public"))
+
+	var configs []istioModel.Config
+	for _, configType := range istioConfigTypes {
+		configsOfType, err := configStore.ListIstioConfigs(configType, BindingSelector("bind-id"))
+		g.Expect(err).NotTo(HaveOccurred())
+		configs = append(configs, configsOfType...)
+	}
+	g.Expect(configs).To(HaveLen(6))
+	for _, config := range configs {
+		g.Expect(config.Labels).To(HaveKeyWithValue(instanceIdKey, "instance-id"))
+		g.Expect(config.Annotations).To(HaveKeyWithValue(networkProfileKey, "urn:local.test:public"))
+	}
+	g.Expect(configStore.BindingRecords["bind-id"].Metadata.InstanceId).To(Equal("instance-id"))
+
+	services, err = configStore.ListServices(BindingSelector("other-id"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(services).To(BeEmpty())
+}
+
+func TestConsumerInterceptorPostBindRecordsObjects(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint, providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	record := configStore.BindingRecords["bind-id"]
+	g.Expect(record.Services).To(Equal([]string{"svc-0-bind-id", "svc-1-bind-id"}))
+	g.Expect(record.IstioConfigs).To(HaveLen(12))
+	g.Expect(record.IstioConfigs).To(ContainElement(IstioConfigRef{Type: "virtual-service", Name: "mesh-to-egress-svc-1-bind-id"}))
+}
+
+func TestConsumerInterceptorPostBindRemovesRecordOnError(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{CreateServiceErr: errors.New("forbidden")}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(configStore.BindingRecords).To(BeEmpty())
+}
+
+func TestConsumerInterceptorPostDeleteRemovesOnlyRecordedObjects(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "other-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	err = interceptor.PostDelete("bind-id")
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.DeletedServices).To(Equal([]string{"svc-0-bind-id"}))
+	g.Expect(configStore.DeletedIstioConfigs).To(HaveLen(6))
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.BindingRecords).To(HaveKey("other-id"))
+	g.Expect(configStore.BindingRecords).NotTo(HaveKey("bind-id"))
+}
+
+func TestConsumerInterceptorPostDeleteWithoutRecord(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.DeleteBindingRecord("bind-id")).To(Succeed())
+
+	err = interceptor.PostDelete("bind-id")
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.CreatedServices).To(HaveLen(0))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(0))
+}
+
+func TestConsumerInterceptorPostDeleteWithoutRecordRemovesLabeledObjects(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	endpoints := []model.Endpoint{providerEndpoint, providerEndpoint, providerEndpoint, providerEndpoint, providerEndpoint}
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(endpoints...), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "other-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.DeleteBindingRecord("bind-id")).To(Succeed())
+	for index := 1; index <= 3; index++ {
+		g.Expect(configStore.DeleteService(serviceName(index, "bind-id"))).To(Succeed())
+	}
+
+	err = interceptor.PostDelete("bind-id")
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.CreatedServices[0].Name).To(Equal("svc-0-other-id"))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(6))
+	g.Expect(configStore.BindingRecords).To(HaveKey("other-id"))
+}
+
+func TestConsumerInterceptorPostDeleteToleratesMissingObjects(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{}
+	record := BindingRecord{BindingId: "bind-id"}
+	record.addService("svc-0-bind-id")
+	configStore.SaveBindingRecord(record)
+	interceptor := ConsumerInterceptor{ConfigStore: configStore}
+
+	err := interceptor.PostDelete("bind-id")
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.BindingRecords).To(BeEmpty())
+}
+
+func TestConsumerInterceptorPostDeleteReportsRemainingObjects(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	configStore.DeleteServiceErr = errors.New("forbidden")
+
+	err = interceptor.PostDelete("bind-id")
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("Service:svc-0-bind-id"))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(0))
+	g.Expect(configStore.BindingRecords["bind-id"].Services).To(Equal([]string{"svc-0-bind-id"}))
+	g.Expect(configStore.BindingRecords["bind-id"].IstioConfigs).To(BeEmpty())
+	g.Expect(configStore.BindingRecords["bind-id"].PendingCleanup).To(BeTrue())
+
+	_, err = interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(*model.HttpError).StatusCode).To(Equal(http.StatusConflict))
+}
+
+func TestConsumerInterceptorPostFetchBinding(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	binding, err := interceptor.PostFetchBinding(bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 5555}}))
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+}
+
+func TestConsumerInterceptorPostFetchBindingWithoutService(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := ConsumerInterceptor{ConfigStore: &MockConfigStore{}, NetworkProfile: "urn:local.test:public"}
+
+	_, err := interceptor.PostFetchBinding(bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("svc-0-bind-id"))
+}
+
+func TestConsumerInterceptorPostCatalog(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := ConsumerInterceptor{ServiceNamePrefix: "istio-"}
+	catalog := model.Catalog{Services: []model.Service{{Name: "istio-postgres"}, {Name: "rabbitmq"}}}
+
+	err := interceptor.PostCatalog(&catalog)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(catalog.Services[0].Name).To(Equal("postgres"))
+	g.Expect(catalog.Services[1].Name).To(Equal("rabbitmq"))
+}
+
+func bindRequestForPlan(serviceId string, planId string) model.BindRequest {
+	return model.BindRequest{AdditionalProperties: model.AdditionalProperties{
+		"service_id": json.RawMessage(`"` + serviceId + `"`),
+		"plan_id":    json.RawMessage(`"` + planId + `"`)}}
+}
+
+func TestConsumerInterceptorPreBindSelectsNetworkProfileOfPlan(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := ConsumerInterceptor{ConsumerId: "consumer", NetworkProfile: "urn:local.test:public",
+		NetworkProfiles: NewNetworkProfiles([]NetworkProfileRule{{PlanId: "private-plan", NetworkProfile: "urn:local.test:private"}})}
+
+	request, err := interceptor.PreBind(bindRequestForPlan("postgres-id", "private-plan"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(request.NetworkData.NetworkProfileId).To(Equal("urn:local.test:private"))
+
+	request, err = interceptor.PreBind(bindRequestForPlan("postgres-id", "other-plan"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(request.NetworkData.NetworkProfileId).To(Equal("urn:local.test:public"))
+}
+
+func TestConsumerInterceptorDisabledPlanBypassesMesh(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConsumerId: "consumer", ConfigStore: configStore, NetworkProfile: "urn:local.test:public",
+		NetworkProfiles: NewNetworkProfiles([]NetworkProfileRule{{PlanId: "direct-plan", Disabled: true}})}
+	bindRequest := bindRequestForPlan("postgres-id", "direct-plan")
+
+	request, err := interceptor.PreBind(bindRequest)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(request.NetworkData.NetworkProfileId).To(BeEmpty())
+	g.Expect(request.NetworkData.Data.ConsumerId).To(BeEmpty())
+
+	binding, err := interceptor.PostBind(bindRequest, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{providerEndpoint}))
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+	g.Expect(configStore.BindingRecords).To(BeEmpty())
+}
+
+func TestConsumerInterceptorPostBindRecordsSelectedNetworkProfile(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConsumerId: "consumer", ConfigStore: configStore, NetworkProfile: "urn:local.test:private",
+		NetworkProfiles: NewNetworkProfiles([]NetworkProfileRule{{ServiceId: "postgres-id", NetworkProfile: "urn:local.test:public"}})}
+
+	_, err := interceptor.PostBind(bindRequestForPlan("postgres-id", "plan"), bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.BindingRecords["bind-id"].Metadata.NetworkProfile).To(Equal("urn:local.test:public"))
+}
+
+func TestConsumerInterceptorPostFetchBindingAcceptsSelectedNetworkProfiles(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConsumerId: "consumer", ConfigStore: configStore, NetworkProfile: "urn:local.test:private",
+		NetworkProfiles: NewNetworkProfiles([]NetworkProfileRule{{ServiceId: "postgres-id", NetworkProfile: "urn:local.test:public"}})}
+	_, err := interceptor.PostBind(bindRequestForPlan("postgres-id", "plan"), bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	binding, err := interceptor.PostFetchBinding(bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 5555}}))
+}
+
+func TestConsumerInterceptorPostCatalogLearnsNetworkProfiles(t *testing.T) {
+	g := NewGomegaWithT(t)
+	request := &web.Request{Request: &http.Request{URL: &url.URL{Path: "/v1/osb/broker/v2/catalog"}}}
+	interceptor := ConsumerInterceptor{NetworkProfile: "urn:local.test:public", NetworkProfiles: NewNetworkProfiles(nil)}
+
+	err := interceptor.ForRequest(request, requestIdsOf(request)).PostCatalog(catalogFromJSON(g, catalogWithPlanMetadata))
+
+	g.Expect(err).NotTo(HaveOccurred())
+	interceptor.brokerId = "broker"
+	bindRequest, _ := interceptor.PreBind(bindRequestForPlan("postgres-id", "private-plan"))
+	g.Expect(bindRequest.NetworkData.NetworkProfileId).To(Equal("urn:local.test:private"))
+}
+
+func bindRequestWithParameters(parameters string) model.BindRequest {
+	return model.BindRequest{
+		NetworkData:          model.NetworkDataRequest{NetworkProfileId: "urn:local.test:public"},
+		AdditionalProperties: model.AdditionalProperties{"parameters": json.RawMessage(parameters)}}
+}
+
+func TestConsumerInterceptorRetriedBindReusesObjects(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	first, err := interceptor.PostBind(bindRequestWithParameters(`{"a": 1, "b": 2}`), bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	retried, err := interceptor.PostBind(bindRequestWithParameters(`{"b": 2, "a": 1}`), bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(retried.Endpoints).To(Equal(first.Endpoints))
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(6))
+	g.Expect(configStore.DeletedServices).To(BeEmpty())
+	g.Expect(configStore.DeletedIstioConfigs).To(BeEmpty())
+}
+
+func TestConsumerInterceptorRetriedBindWithOtherParametersConflicts(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	_, err := interceptor.PostBind(bindRequestWithParameters(`{"a": 1}`), bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	_, err = interceptor.PostBind(bindRequestWithParameters(`{"a": 2}`), bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(*model.HttpError).StatusCode).To(Equal(http.StatusConflict))
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(6))
+	g.Expect(configStore.BindingRecords).To(HaveKey("bind-id"))
+}
+
+func TestConsumerInterceptorRetriedBindWithFailingAdaptKeepsObjects(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	_, err = interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id",
+		func(model.Credentials, []model.EndpointMapping) (*model.BindResponse, error) {
+			return nil, errors.New("broker unavailable")
+		})
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.BindingRecords).To(HaveKey("bind-id"))
+}
+
+func TestConsumerInterceptorPostBindReusesObjectsWithoutRecord(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	configStore.DeleteBindingRecord("bind-id")
+
+	binding, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 5555}}))
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(6))
+	g.Expect(configStore.BindingRecords["bind-id"].Services).To(HaveLen(1))
+}
+
+func TestConsumerInterceptorPostBindConflictsWithServiceOfOtherBinding(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	g.Expect(createObjectsOfBinding(configStore, "svc-0-bind-id", BindingMetadata{BindingId: "other-id"})).To(Succeed())
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(*model.HttpError).StatusCode).To(Equal(http.StatusConflict))
+	g.Expect(err.Error()).To(ContainSubstring("other-id"))
+	g.Expect(configStore.DeletedServices).To(BeEmpty())
+	g.Expect(configStore.DeletedIstioConfigs).To(BeEmpty())
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(6))
+}
+
+func TestConsumerInterceptorPostBindConflictsWithIstioConfigOfOtherBinding(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	g.Expect(createObjectsOfBinding(configStore, "svc-0-bind-id", BindingMetadata{BindingId: "other-id"})).To(Succeed())
+	g.Expect(configStore.DeleteService("svc-0-bind-id")).To(Succeed())
+	configStore.DeletedServices = nil
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(*model.HttpError).StatusCode).To(Equal(http.StatusConflict))
+	g.Expect(err.Error()).To(ContainSubstring("other-id"))
+	g.Expect(configStore.DeletedServices).To(ConsistOf("svc-0-bind-id"))
+	g.Expect(configStore.DeletedIstioConfigs).To(BeEmpty())
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(6))
+	for _, config := range configStore.CreatedIstioConfigs {
+		g.Expect(config.Annotations[bindingIdKey]).To(Equal("other-id"))
+	}
+}
+
+// trackingConfigStore tracks how many istio configs are created at the same time. The services are not held, as
+// the istio configs are only created once their service exists.
+type trackingConfigStore struct {
+	*MockConfigStore
+	tracker *concurrencyTracker
+}
+
+func (s *trackingConfigStore) CreateIstioConfig(config istioModel.Config) error {
+	s.tracker.track()
+	return s.MockConfigStore.CreateIstioConfig(config)
+}
+
+func TestConsumerInterceptorPostBindCreatesObjectsInParallel(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &trackingConfigStore{MockConfigStore: &MockConfigStore{ClusterIp: "10.0.0.1"}, tracker: newConcurrencyTracker(4)}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public", Parallelism: 4}
+
+	binding, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint, providerEndpoint, providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(HaveLen(3))
+	g.Expect(configStore.CreatedServices).To(HaveLen(3))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(18))
+	g.Expect(configStore.tracker.maxRunning()).To(Equal(4))
+}
+
+func TestConsumerInterceptorPostBindCreatesObjectsSequentiallyByDefault(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &trackingConfigStore{MockConfigStore: &MockConfigStore{ClusterIp: "10.0.0.1"}, tracker: newConcurrencyTracker(1)}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint, providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(12))
+	g.Expect(configStore.tracker.maxRunning()).To(Equal(1))
+}
+
+func TestConsumerInterceptorPostBindInParallelRollsBackOnError(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &trackingConfigStore{MockConfigStore: &MockConfigStore{ClusterIp: "10.0.0.1", CreateObjectErr: errors.New("quota exceeded"), CreateObjectErrCount: 7},
+		tracker: newConcurrencyTracker(4)}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public", Parallelism: 4}
+
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint, providerEndpoint, providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(MatchRegexp(`^Can't create [a-z-]+ [a-z0-9-]*svc-[0-2]-bind-id[a-z0-9.-]*: quota exceeded$`))
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+	g.Expect(configStore.CreatedIstioConfigs).To(BeEmpty())
+	g.Expect(configStore.DeletedServices).To(HaveLen(3))
+	g.Expect(configStore.DeletedIstioConfigs).To(HaveLen(7))
+	g.Expect(configStore.BindingRecords).To(BeEmpty())
+}
+
+func TestConsumerInterceptorPostBindReportsFailedService(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{CreateServiceErr: errors.New("forbidden")}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public", Parallelism: 4}
+
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint, providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(MatchRegexp(`^Can't create service svc-[01]-bind-id: forbidden$`))
+}
+
+func TestConsumerInterceptorBindsAndUnbindsBindingIdsThatAreNoValidNames(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	bindId := "Binding_" + strings.Repeat("0E9D7C5A-4A8E-4C3B", 4)
+
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), bindId, adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.CreatedServices[0].Annotations[bindingIdKey]).To(Equal(bindId))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(6))
+
+	err = interceptor.PostDelete(bindId)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+	g.Expect(configStore.CreatedIstioConfigs).To(BeEmpty())
+	g.Expect(configStore.BindingRecords).To(BeEmpty())
+}
+
+func TestConsumerInterceptorPostDeleteWithoutRecordFindsServicesWithLegacyNames(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	bindId := "0e9d7c5a-4a8e-4c3b-9f4e-2b6a1d8c7e3f-extra"
+	g.Expect(createObjectsOfBinding(configStore, legacyServiceName(0, bindId), BindingMetadata{BindingId: bindId})).To(Succeed())
+	g.Expect(legacyServiceName(0, bindId)).NotTo(Equal(serviceName(0, bindId)))
+	interceptor := ConsumerInterceptor{ConfigStore: configStore}
+
+	err := interceptor.PostDelete(bindId)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+	g.Expect(configStore.CreatedIstioConfigs).To(BeEmpty())
+}
@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"github.com/Peripli/service-manager/pkg/health"
+	"github.com/Peripli/service-manager/pkg/web"
+)
+
+// healthProbe checks the access to the kubernetes API and istio resources without listing all objects
+type healthProbe interface {
+	probeServices(namespace string) error
+	probeIstioConfigType(configType string) error
+}
+
+// kubernetesHealthIndicator is down if the services of the plugin namespace or the target namespace can't be
+// accessed with the service account of the plugin
+type kubernetesHealthIndicator struct {
+	probe      healthProbe
+	namespaces []string
+}
+
+func (i kubernetesHealthIndicator) Name() string {
+	return "istio-kubernetes"
+}
+
+func (i kubernetesHealthIndicator) Health() *health.Health {
+	result := health.New().Up().WithDetail("namespaces", i.namespaces)
+	for _, namespace := range i.namespaces {
+		if err := i.probe.probeServices(namespace); err != nil {
+			result.Down().WithDetail(namespace, err.Error())
+		}
+	}
+	return result
+}
+
+// istioHealthIndicator is down if the networking.istio.io resources used for the generated configs are not available
+type istioHealthIndicator struct {
+	probe healthProbe
+}
+
+func (i istioHealthIndicator) Name() string {
+	return "istio-crds"
+}
+
+func (i istioHealthIndicator) Health() *health.Health {
+	result := health.New().Up()
+	for _, configType := range istioConfigTypes {
+		if err := i.probe.probeIstioConfigType(configType); err != nil {
+			result.Down().WithDetail(configType, err.Error())
+		}
+	}
+	return result
+}
+
+// configurationHealthIndicator is down if binds are certain to fail because of missing configuration.
+// Missing global values are fine if all brokers override them.
+type configurationHealthIndicator struct {
+	interceptor ConsumerInterceptor
+	brokers     map[string]BrokerSettings
+}
+
+func (i configurationHealthIndicator) Name() string {
+	return "istio-configuration"
+}
+
+func (i configurationHealthIndicator) Health() *health.Health {
+	result := health.New().Up()
+	if i.interceptor.NetworkProfile == "" && globalRequired(i.brokers, func(b BrokerSettings) string { return b.NetworkProfile }) {
+		result.Down().WithDetail("network_profile", "not configured")
+	}
+	if i.interceptor.ConsumerId == "" && globalRequired(i.brokers, func(b BrokerSettings) string { return b.ConsumerId }) {
+		result.Down().WithDetail("consumer_id", "not configured")
+	}
+	return result
+}
+
+// registerHealthIndicators registers the indicators, the kubernetes API is checked in the given namespaces
+func registerHealthIndicators(api *web.API, probe healthProbe, namespaces []string, interceptor ConsumerInterceptor,
+	brokers map[string]BrokerSettings) {
+	api.AddHealthIndicator(kubernetesHealthIndicator{probe, namespaces})
+	api.AddHealthIndicator(istioHealthIndicator{probe})
+	api.AddHealthIndicator(configurationHealthIndicator{interceptor, brokers})
+}
@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/Peripli/service-manager/pkg/health"
+	"github.com/Peripli/service-manager/pkg/web"
+	. "github.com/onsi/gomega"
+)
+
+func TestHealthIndicatorsRegistration(t *testing.T) {
+	g := NewGomegaWithT(t)
+	api := web.API{Registry: health.NewDefaultRegistry()}
+
+	registerHealthIndicators(&api, &MockConfigStore{}, []string{"catalog"}, ConsumerInterceptor{}, nil)
+
+	var names []string
+	for _, indicator := range api.HealthIndicators() {
+		names = append(names, indicator.Name())
+	}
+	g.Expect(names).To(ConsistOf("ping", "istio-kubernetes", "istio-crds", "istio-configuration"))
+}
+
+func TestKubernetesHealthIndicator(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{}
+	indicator := kubernetesHealthIndicator{configStore, []string{"catalog", "egress"}}
+
+	g.Expect(indicator.Health().Status).To(Equal(health.StatusUp))
+	g.Expect(indicator.Health().Details).To(HaveKeyWithValue("namespaces", []string{"catalog", "egress"}))
+
+	configStore.ListErr = errors.New("services is forbidden")
+	result := indicator.Health()
+	g.Expect(result.Status).To(Equal(health.StatusDown))
+	g.Expect(result.Details).To(HaveKeyWithValue("egress", "services is forbidden"))
+	content, err := json.Marshal(result)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(content)).To(ContainSubstring(`"egress":"services is forbidden"`))
+}
+
+func TestIstioHealthIndicator(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{}
+	indicator := istioHealthIndicator{configStore}
+
+	g.Expect(indicator.Health().Status).To(Equal(health.StatusUp))
+
+	configStore.ListErr = errors.New("the server could not find the requested resource")
+	result := indicator.Health()
+	g.Expect(result.Status).To(Equal(health.StatusDown))
+	g.Expect(result.Details).To(HaveKeyWithValue("virtual-service", "the server could not find the requested resource"))
+}
+
+func TestHealthNamespacesIncludeTargetNamespace(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{}
+
+	g.Expect(healthNamespaces(&Settings{}, configStore)).To(Equal([]string{"catalog"}))
+	g.Expect(healthNamespaces(&Settings{TargetNamespace: "catalog"}, configStore)).To(Equal([]string{"catalog"}))
+	g.Expect(healthNamespaces(&Settings{TargetNamespace: "egress"}, configStore)).To(Equal([]string{"catalog", "egress"}))
+}
+
+func TestConfigurationHealthIndicator(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	indicator := configurationHealthIndicator{ConsumerInterceptor{ConsumerId: "consumer", NetworkProfile: "urn:local.test:public"}, nil}
+	g.Expect(indicator.Health().Status).To(Equal(health.StatusUp))
+
+	indicator = configurationHealthIndicator{ConsumerInterceptor{ConsumerId: "consumer"}, nil}
+	result := indicator.Health()
+	g.Expect(result.Status).To(Equal(health.StatusDown))
+	g.Expect(result.Details).To(HaveKeyWithValue("network_profile", "not configured"))
+	g.Expect(result.Details).NotTo(HaveKey("consumer_id"))
+
+	indicator = configurationHealthIndicator{ConsumerInterceptor{ConsumerId: "consumer"},
+		map[string]BrokerSettings{"broker": {NetworkProfile: "urn:local.test:public"}}}
+	g.Expect(indicator.Health().Status).To(Equal(health.StatusUp))
+}
+
+func TestKubeConfigStoreProbesHealth(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var configStore ConfigStore = kubeConfigStore{}
+
+	_, ok := configStore.(healthProbe)
+
+	g.Expect(ok).To(BeTrue())
+}
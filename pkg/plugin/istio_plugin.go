@@ -1,11 +1,11 @@
 package plugin
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/spf13/viper"
-	"log"
 	"net/http"
+	"os"
 	"strings"
 
 	"github.com/Peripli/istio-broker-proxy/pkg/model"
@@ -13,81 +13,310 @@ import (
 	"github.com/Peripli/service-manager/pkg/web"
 )
 
+const (
+	lastOperationPath = "/last_operation"
+	stateSucceeded    = "succeeded"
+	stateInProgress   = "in progress"
+	stateFailed       = "failed"
+
+	operationBind         = "bind"
+	operationUnbind       = "unbind"
+	operationPollBinding  = "poll_binding"
+	operationFetchBinding = "fetch_binding"
+	operationCatalog      = "catalog"
+)
+
+type lastOperation struct {
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+}
+
+// bindingFetchInterceptor is implemented by interceptors that also rewrite bindings fetched from the broker
+type bindingFetchInterceptor interface {
+	PostFetchBinding(response model.BindResponse, bindId string,
+		adapt func(model.Credentials, []model.EndpointMapping) (*model.BindResponse, error)) (*model.BindResponse, error)
+}
+
+// asyncBindInterceptor is implemented by interceptors that need to know about binds the broker processes asynchronously
+type asyncBindInterceptor interface {
+	PostBindAccepted(request model.BindRequest, bindId string) error
+	// IsBindPending returns true if an asynchronous bind of the binding was accepted and is not finished yet
+	IsBindPending(bindId string) (bool, error)
+}
+
+// RequestScopedInterceptor is implemented by interceptors that need details of the OSB request
+// beyond the binding id, e.g. the service instance id
+type RequestScopedInterceptor interface {
+	ForRequest(request *web.Request, ids RequestIds) router.ServiceBrokerInterceptor
+}
+
 type IstioPlugin struct {
-	interceptor router.ServiceBrokerInterceptor
+	interceptor        router.ServiceBrokerInterceptor
+	brokerInterceptors map[string]router.ServiceBrokerInterceptor
+	bindingLock        BindingLock
+	// orphanMitigation is the retry policy for unbinding bindings at the broker that could not be added to the
+	// service mesh. Without it, such bindings are left at the broker.
+	orphanMitigation *RetryPolicy
 }
 
 func (i *IstioPlugin) Name() string {
 	return "istio"
 }
 
-func logError(err error) {
-	log.Printf("error occured: %s\n", err.Error())
+// interceptorFor returns the interceptor of the broker of the request, falling back to the default interceptor
+func (i *IstioPlugin) interceptorFor(request *web.Request) router.ServiceBrokerInterceptor {
+	interceptor := i.interceptor
+	ids := requestIdsOf(request)
+	if brokerInterceptor, ok := i.brokerInterceptors[strings.ToLower(ids.BrokerId)]; ok {
+		interceptor = brokerInterceptor
+	}
+	if scoped, ok := interceptor.(RequestScopedInterceptor); ok {
+		return scoped.ForRequest(request, ids)
+	}
+	return interceptor
+}
+
+// lockBinding serializes the operations on the binding. Without a binding lock nothing is locked.
+func (i *IstioPlugin) lockBinding(request *web.Request, bindId string) (func(), error) {
+	if i.bindingLock == nil {
+		return func() {}, nil
+	}
+	return i.bindingLock.Lock(request.Context(), bindId)
 }
 
 func (i *IstioPlugin) Bind(request *web.Request, next web.Handler) (*web.Response, error) {
+	logger := withRequestLogger(request, operationBind)
 	var bindRequest model.BindRequest
-	log.Printf("IstioPlugin bind was triggered\n")
+	logger.Debug("IstioPlugin bind was triggered")
 	err := json.Unmarshal(request.Body, &bindRequest)
 	if err != nil {
-		return httpError(err, http.StatusBadRequest)
+		return httpError(request.Context(), err, http.StatusBadRequest)
 	}
 
 	peripliContext := &PeripliContext{request: request, next: next}
-	client := router.InterceptedOsbClient{&router.OsbClient{peripliContext}, i.interceptor}
-	bindId := extractBindId(request.URL.Path)
+	client := &router.OsbClient{RestClient: peripliContext}
+	bindingPath := request.URL.Path
+	bindId, err := extractBindId(request)
+	if err != nil {
+		return httpError(request.Context(), err, http.StatusBadRequest)
+	}
+	unlock, err := i.lockBinding(request, bindId)
+	if err != nil {
+		return httpError(request.Context(), err, http.StatusBadGateway)
+	}
+	defer unlock()
 
-	bindResponse, err := client.Bind(bindId, &bindRequest)
+	interceptor := i.interceptorFor(request)
+	interceptedRequest, err := interceptor.PreBind(bindRequest)
+	if err != nil {
+		return peripliContext.JSON(nil, err)
+	}
+	bindResponse, err := client.Bind(interceptedRequest)
+	if err != nil {
+		return peripliContext.JSON(nil, err)
+	}
+	if peripliContext.response.StatusCode == http.StatusAccepted {
+		logger.Infof("IstioPlugin bind %s is processed asynchronously", bindId)
+		if accepted, ok := interceptor.(asyncBindInterceptor); ok {
+			err = accepted.PostBindAccepted(*interceptedRequest, bindId)
+			if err != nil {
+				logger.Errorf("IstioPlugin can't record asynchronous bind %s: %s", bindId, err.Error())
+			}
+		}
+		return peripliContext.response, nil
+	}
+	created := peripliContext.response.StatusCode == http.StatusCreated
+	bindResponse, err = interceptor.PostBind(*interceptedRequest, *bindResponse, bindId, observeAdaptCredentials(client.AdaptCredentials))
+	if err != nil && created {
+		i.mitigateOrphan(request, next, bindingPath, additionalString(bindRequest.AdditionalProperties, "service_id"),
+			additionalString(bindRequest.AdditionalProperties, "plan_id"), bindId)
+	}
 
 	return peripliContext.JSON(bindResponse, err)
 }
 
+func (i *IstioPlugin) PollBinding(request *web.Request, next web.Handler) (*web.Response, error) {
+	logger := withRequestLogger(request, operationPollBinding)
+	logger.Debug("IstioPlugin poll binding was triggered")
+	bindingPath := strings.TrimSuffix(request.URL.Path, lastOperationPath)
+	bindId, err := extractBindId(request)
+	if err != nil {
+		return httpError(request.Context(), err, http.StatusBadRequest)
+	}
+	response, err := next.Handle(request)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return response, err
+	}
+
+	var operation lastOperation
+	err = json.Unmarshal(response.Body, &operation)
+	if err != nil {
+		return httpError(request.Context(), fmt.Errorf("Can't unmarshal response from %s: %s", request.URL.String(), err.Error()), http.StatusBadGateway)
+	}
+	if operation.State != stateSucceeded {
+		return response, nil
+	}
+	unlock, err := i.lockBinding(request, bindId)
+	if err != nil {
+		logger.Infof("IstioPlugin binding %s is locked by another operation, reporting it as in progress: %s", bindId, err.Error())
+		response.Body, err = json.Marshal(lastOperation{State: stateInProgress})
+		if err != nil {
+			return httpError(request.Context(), err, http.StatusInternalServerError)
+		}
+		return response, nil
+	}
+	defer unlock()
+
+	// the last operation of an asynchronous unbind, or of a bind that is already finished, is passed through
+	interceptor := i.interceptorFor(request)
+	accepted, ok := interceptor.(asyncBindInterceptor)
+	if !ok {
+		return response, nil
+	}
+	pending, err := accepted.IsBindPending(bindId)
+	if err != nil {
+		logger.Errorf("IstioPlugin can't read record of binding %s, reporting it as in progress: %s", bindId, err.Error())
+		response.Body, err = json.Marshal(lastOperation{State: stateInProgress})
+		if err != nil {
+			return httpError(request.Context(), err, http.StatusInternalServerError)
+		}
+		return response, nil
+	}
+	if !pending {
+		return response, nil
+	}
+
+	request.URL.Path = bindingPath
+	query := request.URL.Query()
+	query.Del("operation")
+	request.URL.RawQuery = query.Encode()
+	peripliContext := &PeripliContext{request: request, next: next}
+	client := &router.OsbClient{RestClient: peripliContext}
+	var bindResponse model.BindResponse
+	err = peripliContext.Get().Do().Into(&bindResponse)
+	if err != nil {
+		// the binding is not confirmed by the broker, so there is no orphan to unbind
+		logger.Errorf("IstioPlugin binding %s could not be fetched from the broker: %s", bindId, err.Error())
+		operation = lastOperation{State: stateFailed, Description: fmt.Sprintf("Binding %s could not be fetched from the broker: %s", bindId, err.Error())}
+	} else if _, err = interceptor.PostBind(model.BindRequest{}, bindResponse, bindId, observeAdaptCredentials(client.AdaptCredentials)); err != nil {
+		logger.Errorf("IstioPlugin binding %s could not be added to the service mesh: %s", bindId, err.Error())
+		i.mitigateOrphan(request, next, bindingPath, query.Get("service_id"), query.Get("plan_id"), bindId)
+		operation = lastOperation{State: stateFailed, Description: fmt.Sprintf("Binding %s could not be added to the service mesh: %s", bindId, err.Error())}
+	} else {
+		return response, nil
+	}
+	response.Body, err = json.Marshal(operation)
+	if err != nil {
+		return httpError(request.Context(), err, http.StatusInternalServerError)
+	}
+	return response, nil
+}
+
+// Unbind removes the binding at the broker and then its objects. If the broker already removed the binding,
+// e.g. when an unbind whose clean up failed is retried, the objects are removed nevertheless.
 func (i *IstioPlugin) Unbind(request *web.Request, next web.Handler) (*web.Response, error) {
-	log.Printf("IstioPlugin unbind was triggered\n")
+	logger := withRequestLogger(request, operationUnbind)
+	logger.Debug("IstioPlugin unbind was triggered")
 	peripliContext := &PeripliContext{request: request, next: next}
-	client := router.InterceptedOsbClient{&router.OsbClient{peripliContext}, i.interceptor}
-	bindId := extractBindId(request.URL.Path)
-	err := client.Unbind(bindId)
+	client := &router.OsbClient{RestClient: peripliContext}
+	bindId, err := extractBindId(request)
+	if err != nil {
+		return httpError(request.Context(), err, http.StatusBadRequest)
+	}
+	unlock, err := i.lockBinding(request, bindId)
+	if err != nil {
+		return httpError(request.Context(), err, http.StatusBadGateway)
+	}
+	defer unlock()
+	interceptor := i.interceptorFor(request)
+	err = client.Unbind()
+	if httpError, ok := err.(*model.HttpError); ok && httpError.StatusCode == http.StatusGone {
+		if cleanupErr := interceptor.PostDelete(bindId); cleanupErr != nil {
+			logger.Errorf("IstioPlugin can't remove objects of binding %s, which is gone at the broker: %s", bindId, cleanupErr.Error())
+		}
+		return peripliContext.response, nil
+	}
+	if err == nil {
+		err = interceptor.PostDelete(bindId)
+	}
 	return peripliContext.JSON(nil, err)
 }
 
+func (i *IstioPlugin) FetchBinding(request *web.Request, next web.Handler) (*web.Response, error) {
+	withRequestLogger(request, operationFetchBinding).Debug("IstioPlugin fetch binding was triggered")
+	peripliContext := &PeripliContext{request: request, next: next}
+	client := &router.OsbClient{RestClient: peripliContext}
+	bindId, err := extractBindId(request)
+	if err != nil {
+		return httpError(request.Context(), err, http.StatusBadRequest)
+	}
+
+	var bindResponse model.BindResponse
+	err = peripliContext.Get().Do().Into(&bindResponse)
+	if err != nil {
+		return peripliContext.JSON(nil, err)
+	}
+	fetchInterceptor, ok := i.interceptorFor(request).(bindingFetchInterceptor)
+	if !ok {
+		return peripliContext.response, nil
+	}
+	binding, err := fetchInterceptor.PostFetchBinding(bindResponse, bindId, observeAdaptCredentials(client.AdaptCredentials))
+
+	return peripliContext.JSON(binding, err)
+}
+
 func (i *IstioPlugin) FetchCatalog(request *web.Request, next web.Handler) (*web.Response, error) {
+	withRequestLogger(request, operationCatalog).Debug("IstioPlugin fetch catalog was triggered")
 	peripliContext := &PeripliContext{request: request, next: next}
-	client := router.InterceptedOsbClient{&router.OsbClient{peripliContext}, i.interceptor}
+	client := router.InterceptedOsbClient{OsbClient: &router.OsbClient{RestClient: peripliContext}, Interceptor: i.interceptorFor(request)}
 
 	catalog, err := client.GetCatalog()
 
 	return peripliContext.JSON(catalog, err)
 }
 
-func extractBindId(path string) string {
-	splitPath := strings.Split(path, "/")
-	if splitPath[len(splitPath)-2] != "service_bindings" {
-		panic(fmt.Sprintf("Failed to extract binding id from path %s", path))
+func createConsumerInterceptor(settings *Settings, configStore ConfigStore) ConsumerInterceptor {
+	consumerInterceptor := ConsumerInterceptor{}
+	consumerInterceptor.ServiceNamePrefix = settings.ServiceNamePrefix
+	consumerInterceptor.NetworkProfile = settings.NetworkProfile
+	consumerInterceptor.ConsumerId = settings.ConsumerId
+	consumerInterceptor.NetworkProfiles = NewNetworkProfiles(settings.NetworkProfiles)
+	consumerInterceptor.TargetNamespace = settings.TargetNamespace
+	consumerInterceptor.Parallelism = settings.CreateParallelism
+	consumerInterceptor.Topology = settings.MeshTopology()
+	if settings.TargetNamespaceTemplate != "" {
+		consumerInterceptor.TargetNamespaceTemplate, _ = NewNamespaceTemplate(settings.TargetNamespaceTemplate)
 	}
-	return splitPath[len(splitPath)-1]
-}
-
-func createConsumerInterceptor(configStore router.ConfigStore) router.ConsumerInterceptor {
-	config := viper.New()
-	config.SetEnvPrefix("istio")
-	config.BindEnv("service_name_prefix")
-	config.BindEnv("consumer_id")
-	config.BindEnv("network_profile")
-	config.SetDefault("service_name_prefix", "istio-")
-	consumerInterceptor := router.ConsumerInterceptor{}
-	consumerInterceptor.ServiceNamePrefix = config.GetString("service_name_prefix")
-	consumerInterceptor.NetworkProfile = config.GetString("network_profile")
-	consumerInterceptor.ConsumerId = config.GetString("consumer_id")
-	log.Printf("IstioPlugin starting with configuration service_name_prefix=%s consumer_id=%s network_profile=%s\n",
+	loggerFor(context.Background()).Infof("IstioPlugin starting with configuration service_name_prefix=%s consumer_id=%s network_profile=%s",
 		consumerInterceptor.ServiceNamePrefix, consumerInterceptor.ConsumerId, consumerInterceptor.NetworkProfile)
 	consumerInterceptor.ConfigStore = configStore
 	return consumerInterceptor
 }
 
-func httpError(err error, statusCode int) (*web.Response, error) {
-	log.Printf("ERROR: %s\n", err.Error())
+// createBrokerInterceptors derives an interceptor with the consumer identity of each configured broker
+func createBrokerInterceptors(settings *Settings, consumerInterceptor ConsumerInterceptor) map[string]router.ServiceBrokerInterceptor {
+	brokerInterceptors := make(map[string]router.ServiceBrokerInterceptor)
+	for brokerId, brokerSettings := range settings.Brokers {
+		brokerInterceptor := consumerInterceptor
+		if brokerSettings.ServiceNamePrefix != "" {
+			brokerInterceptor.ServiceNamePrefix = brokerSettings.ServiceNamePrefix
+		}
+		if brokerSettings.ConsumerId != "" {
+			brokerInterceptor.ConsumerId = brokerSettings.ConsumerId
+		}
+		if brokerSettings.NetworkProfile != "" {
+			brokerInterceptor.NetworkProfile = brokerSettings.NetworkProfile
+		}
+		loggerFor(context.Background()).Infof("IstioPlugin using configuration service_name_prefix=%s consumer_id=%s network_profile=%s for broker %s",
+			brokerInterceptor.ServiceNamePrefix, brokerInterceptor.ConsumerId, brokerInterceptor.NetworkProfile, brokerId)
+		brokerInterceptors[strings.ToLower(brokerId)] = brokerInterceptor
+	}
+	return brokerInterceptors
+}
+
+func httpError(ctx context.Context, err error, statusCode int) (*web.Response, error) {
 	httpError := model.HttpErrorFromError(err, statusCode)
+	loggerFor(ctx).Error(strings.TrimSpace(httpError.ErrorMsg + " " + httpError.Description))
 	response := &web.Response{StatusCode: httpError.StatusCode}
 	response.Body, err = json.Marshal(httpError)
 	if err != nil {
@@ -96,11 +325,81 @@ func httpError(err error, statusCode int) (*web.Response, error) {
 	return response, nil
 }
 
-func NewIstioPlugin() *IstioPlugin {
-	return &IstioPlugin{interceptor: createConsumerInterceptor(router.NewInClusterConfigStore())}
+// NewIstioPlugin creates a plugin that intercepts the requests to the brokers with the given ids, in lower case,
+// with their own interceptor and all other requests with the default interceptor. Binds, unbinds and polls of
+// the same binding are serialized by the binding lock.
+func NewIstioPlugin(interceptor router.ServiceBrokerInterceptor, brokerInterceptors map[string]router.ServiceBrokerInterceptor,
+	bindingLock BindingLock) *IstioPlugin {
+	return &IstioPlugin{interceptor: interceptor, brokerInterceptors: brokerInterceptors, bindingLock: bindingLock}
+}
+
+// createBindingLock locks bindings within the proxy or, with lock_lease, across its replicas
+func createBindingLock(settings *Settings, configStore ConfigStore) (BindingLock, error) {
+	if !settings.LockLease {
+		return newLocalBindingLock(settings.LockTimeout), nil
+	}
+	leases, ok := configStore.(LeaseStore)
+	if !ok {
+		return nil, fmt.Errorf("Leases are not supported by the kubernetes connection")
+	}
+	holder, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("Can't determine the lease holder identity: %s", err.Error())
+	}
+	return newLeaseBindingLock(settings.LockTimeout, leases, holder, settings.LockLeaseDuration), nil
+}
+
+// healthNamespaces returns the namespace of the plugin and the configured target namespace, if any. Namespaces
+// derived from bind requests are not known in advance.
+func healthNamespaces(settings *Settings, configStore ConfigStore) []string {
+	namespaces := []string{configStore.Namespace()}
+	if settings.TargetNamespace != "" && settings.TargetNamespace != configStore.Namespace() {
+		namespaces = append(namespaces, settings.TargetNamespace)
+	}
+	return namespaces
 }
 
-func InitIstioPlugin(api *web.API) {
-	istioPlugin := NewIstioPlugin()
-	api.RegisterPlugins(istioPlugin)
+// InitIstioPlugin registers the plugin at the API. It fails if the plugin configuration is invalid.
+func InitIstioPlugin(api *web.API) error {
+	settings, err := LoadSettings(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	err = settings.Validate()
+	if err != nil {
+		return fmt.Errorf("Invalid istio plugin configuration: %s", err.Error())
+	}
+	err = setLogLevel(settings.LogLevel)
+	if err != nil {
+		return err
+	}
+	kubeConfigStore, err := NewConfigStore(settings.Namespace, valueOr(settings.ClusterDomain, defaultClusterDomain))
+	if err != nil {
+		return fmt.Errorf("Can't connect to kubernetes: %s", err.Error())
+	}
+	configStore := newRetryingConfigStore(instrumentedConfigStore{kubeConfigStore}, settings.RetryPolicy())
+	consumerInterceptor := createConsumerInterceptor(settings, configStore)
+	bindingLock, err := createBindingLock(settings, kubeConfigStore)
+	if err != nil {
+		return err
+	}
+	istioPlugin := NewIstioPlugin(consumerInterceptor, createBrokerInterceptors(settings, consumerInterceptor), bindingLock)
+	if settings.OrphanMitigation {
+		orphanMitigation := settings.RetryPolicy()
+		istioPlugin.orphanMitigation = &orphanMitigation
+	}
+	api.RegisterPlugins(instrumentedPlugin{istioPlugin})
+	api.RegisterControllers(metricsController{metricsRegistry})
+	if probe, ok := kubeConfigStore.(healthProbe); ok {
+		registerHealthIndicators(api, probe, healthNamespaces(settings, kubeConfigStore), consumerInterceptor, settings.Brokers)
+	}
+	reconciler := NewReconciler(configStore, settings.ReconcileInterval, settings.ReconcileDryRun)
+	reconciler.AsyncBindTimeout = settings.AsyncBindTimeout
+	reconciler.Lock = bindingLock
+	if settings.TargetNamespace != "" {
+		reconciler.Namespaces = []string{settings.TargetNamespace}
+	}
+	reconciler.AllNamespaces = settings.TargetNamespaceTemplate != ""
+	reconciler.Start(nil)
+	return nil
 }
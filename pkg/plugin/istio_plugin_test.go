@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
 	"testing"
 
@@ -14,6 +13,8 @@ import (
 
 	"github.com/Peripli/istio-broker-proxy/pkg/model"
 	"github.com/Peripli/service-manager/pkg/web"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	. "github.com/onsi/gomega"
 )
@@ -24,7 +25,7 @@ func TestIstioPluginRegistration(t *testing.T) {
 	api := web.API{}
 	istioPlugin := &IstioPlugin{}
 	api.RegisterPlugins(istioPlugin)
-	g.Expect(len(api.Filters)).To(Equal(3))
+	g.Expect(len(api.Filters)).To(Equal(5))
 }
 
 func TestIstioPluginBind(t *testing.T) {
@@ -64,6 +65,43 @@ func TestIstioPluginBind(t *testing.T) {
 
 }
 
+func TestIstioPluginBindAsync(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := SpyPostBindInterceptor{}
+	plugin := IstioPlugin{interceptor: &interceptor}
+	nextHandler := SpyWebHandler{statusCode: http.StatusAccepted, responseBody: []byte(`{"operation": "task-1"}`)}
+
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345?accepts_incomplete=true")
+	origRequest := http.Request{URL: origURL, Method: http.MethodPut}
+	request := web.Request{Request: &origRequest, Body: []byte("{}")}
+
+	response, err := plugin.Bind(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusAccepted))
+	g.Expect(response.Body).To(MatchJSON(`{"operation": "task-1"}`))
+	g.Expect(interceptor.bindId).To(BeEmpty())
+}
+
+func TestIstioPluginBindAsyncRecordsAcceptedBinding(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{}
+	plugin := IstioPlugin{interceptor: ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public", TargetNamespace: "egress"}}
+	nextHandler := SpyWebHandler{statusCode: http.StatusAccepted, responseBody: []byte(`{"operation": "task-1"}`)}
+
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345?accepts_incomplete=true")
+	request := web.Request{Request: &http.Request{URL: origURL, Method: http.MethodPut}, Body: []byte("{}")}
+
+	response, err := plugin.Bind(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusAccepted))
+	record := configStore.BindingRecords["34234234234-43535-345345345"]
+	g.Expect(record.Namespace).To(Equal("egress"))
+	g.Expect(record.Metadata.InstanceId).To(Equal("3234234-234234-234234"))
+	g.Expect(record.isEmpty()).To(BeTrue())
+}
+
 func TestIstioPluginBindForbidden(t *testing.T) {
 	g := NewGomegaWithT(t)
 	var err error
@@ -143,7 +181,7 @@ func TestIstioPluginBindInvalidBindResponse(t *testing.T) {
 func TestIstioPluginBindOkButAdaptForbidden(t *testing.T) {
 	g := NewGomegaWithT(t)
 	var err error
-	plugin := IstioPlugin{interceptor: router.ConsumerInterceptor{NetworkProfile: "urn:local.test:public"}}
+	plugin := IstioPlugin{interceptor: ConsumerInterceptor{NetworkProfile: "urn:local.test:public"}}
 	nextHandler := SpyWebHandler{statusCode: http.StatusForbidden, responseBody: []byte("{}")}
 
 	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345")
@@ -161,8 +199,8 @@ func TestIstioPluginBindOkButAdaptForbidden(t *testing.T) {
 func TestIstioPluginBindInvalidAdaptCredentialsResponseWithoutEndpoints(t *testing.T) {
 	g := NewGomegaWithT(t)
 	var err error
-	configStore := &router.MockConfigStore{}
-	plugin := IstioPlugin{interceptor: router.ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}}
+	configStore := &MockConfigStore{}
+	plugin := IstioPlugin{interceptor: ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}}
 	nextHandler := SpyWebHandler{responseBody: []byte(`{"network_data": {"network_profile_id": "urn:local.test:public"}}`)}
 
 	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345")
@@ -182,13 +220,13 @@ func TestIstioPluginBindInvalidAdaptCredentialsResponseWithoutEndpoints(t *testi
 func TestIstioPluginBindInvalidAdaptCredentialsResponseWithEndpoints(t *testing.T) {
 	g := NewGomegaWithT(t)
 	var err error
-	configStore := &router.MockConfigStore{}
-	plugin := IstioPlugin{interceptor: router.ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}}
+	configStore := &MockConfigStore{}
+	plugin := IstioPlugin{interceptor: ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}}
 	targetEndpoint := model.Endpoint{Host: "host2", Port: 8888}
 	endpointsResponse, _ := json.Marshal(model.BindResponse{Endpoints: []model.Endpoint{targetEndpoint},
 		NetworkData: model.NetworkDataResponse{
 			NetworkProfileId: "urn:local.test:public",
-			Data: model.DataResponse{Endpoints: []model.Endpoint{targetEndpoint}}}})
+			Data:             model.DataResponse{ProviderId: "provider", Endpoints: []model.Endpoint{targetEndpoint}}}})
 	nextHandler := SpyWebHandler{responseBody: endpointsResponse}
 
 	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345")
@@ -264,12 +302,220 @@ func TestIstioPluginUnbindForbidden(t *testing.T) {
 	g.Expect(response.StatusCode).To(Equal(http.StatusForbidden))
 }
 
+func TestIstioPluginRetriedUnbindRemovesObjectsOfBindingGoneAtBroker(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	plugin := IstioPlugin{interceptor: interceptor}
+	bindId := "34234234234-43535-345345345"
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), bindId, adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/" + bindId)
+	configStore.DeleteServiceErr = errors.New("forbidden")
+
+	response, err := plugin.Unbind(&web.Request{Request: &http.Request{URL: origURL, Method: http.MethodDelete}}, &SpyWebHandler{})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusBadGateway))
+	g.Expect(configStore.BindingRecords[bindId].PendingCleanup).To(BeTrue())
+	g.Expect(configStore.BindingRecords[bindId].Services).To(Equal([]string{"svc-0-" + bindId}))
+
+	configStore.DeleteServiceErr = nil
+	nextHandler := SpyWebHandler{statusCode: http.StatusGone, responseBody: []byte(`{}`)}
+	response, err = plugin.Unbind(&web.Request{Request: &http.Request{URL: origURL, Method: http.MethodDelete}}, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusGone))
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+	g.Expect(configStore.CreatedIstioConfigs).To(BeEmpty())
+	g.Expect(configStore.BindingRecords).To(BeEmpty())
+}
+
+func TestIstioPluginPollBinding(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := SpyPostBindInterceptor{pending: true}
+	plugin := IstioPlugin{interceptor: &interceptor}
+	nextHandler := SpyWebHandler{lastOperationResponseBody: []byte(`{"state": "succeeded"}`), responseBody: []byte(`{}`)}
+
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345/last_operation?operation=task-1&plan_id=plan")
+	origRequest := http.Request{URL: origURL, Method: http.MethodGet}
+	request := web.Request{Request: &origRequest}
+
+	response, err := plugin.PollBinding(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusOK))
+	g.Expect(response.Body).To(MatchJSON(`{"state": "succeeded"}`))
+	g.Expect(interceptor.bindId).To(Equal("34234234234-43535-345345345"))
+	g.Expect(nextHandler.method).To(Equal(http.MethodGet))
+	g.Expect(nextHandler.url.Path).To(Equal("/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345"))
+	g.Expect(nextHandler.url.RawQuery).To(Equal("plan_id=plan"))
+}
+
+func TestIstioPluginPollBindingPassesThroughOperationsOtherThanPendingBinds(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := SpyPostBindInterceptor{}
+	plugin := IstioPlugin{interceptor: &interceptor}
+	nextHandler := SpyWebHandler{lastOperationResponseBody: []byte(`{"state": "succeeded"}`), responseBody: []byte(`{}`)}
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345/last_operation")
+
+	response, err := plugin.PollBinding(&web.Request{Request: &http.Request{URL: origURL, Method: http.MethodGet}}, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.Body).To(MatchJSON(`{"state": "succeeded"}`))
+	g.Expect(interceptor.bindId).To(BeEmpty())
+	g.Expect(nextHandler.url.Path).To(HaveSuffix("/last_operation"))
+}
+
+func TestIstioPluginPollBindingAfterAsyncUnbind(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	plugin := IstioPlugin{interceptor: interceptor}
+	bindId := "34234234234-43535-345345345"
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), bindId, adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	bindingURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/" + bindId)
+	response, err := plugin.Unbind(&web.Request{Request: &http.Request{URL: bindingURL, Method: http.MethodDelete}},
+		&SpyWebHandler{statusCode: http.StatusAccepted, responseBody: []byte(`{"operation": "unbind"}`)})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusAccepted))
+	nextHandler := SpyWebHandler{lastOperationResponseBody: []byte(`{"state": "succeeded"}`)}
+	pollURL, _ := url.Parse(bindingURL.String() + "/last_operation?operation=unbind")
+
+	response, err = plugin.PollBinding(&web.Request{Request: &http.Request{URL: pollURL, Method: http.MethodGet}}, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.Body).To(MatchJSON(`{"state": "succeeded"}`))
+	g.Expect(nextHandler.method).To(Equal(http.MethodGet))
+	g.Expect(nextHandler.url.Path).To(HaveSuffix("/last_operation"))
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+}
+
+func TestIstioPluginPollBindingInProgress(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := SpyPostBindInterceptor{}
+	plugin := IstioPlugin{interceptor: &interceptor}
+	nextHandler := SpyWebHandler{lastOperationResponseBody: []byte(`{"state": "in progress"}`)}
+
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345/last_operation")
+	origRequest := http.Request{URL: origURL, Method: http.MethodGet}
+	request := web.Request{Request: &origRequest}
+
+	response, err := plugin.PollBinding(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.Body).To(MatchJSON(`{"state": "in progress"}`))
+	g.Expect(interceptor.bindId).To(BeEmpty())
+}
+
+func TestIstioPluginPollBindingPostBindFails(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := SpyPostBindInterceptor{err: fmt.Errorf("no endpoints"), pending: true}
+	plugin := IstioPlugin{interceptor: &interceptor}
+	nextHandler := SpyWebHandler{lastOperationResponseBody: []byte(`{"state": "succeeded"}`), responseBody: []byte(`{}`)}
+
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345/last_operation")
+	origRequest := http.Request{URL: origURL, Method: http.MethodGet}
+	request := web.Request{Request: &origRequest}
+
+	response, err := plugin.PollBinding(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusOK))
+	var operation lastOperation
+	err = json.Unmarshal(response.Body, &operation)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(operation.State).To(Equal("failed"))
+	g.Expect(operation.Description).To(ContainSubstring("no endpoints"))
+}
+
+func TestIstioPluginPollBindingInvalidResponse(t *testing.T) {
+	g := NewGomegaWithT(t)
+	plugin := IstioPlugin{interceptor: router.NoOpInterceptor{}}
+	nextHandler := SpyWebHandler{lastOperationResponseBody: []byte(`sdfsf`)}
+
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345/last_operation")
+	origRequest := http.Request{URL: origURL, Method: http.MethodGet}
+	request := web.Request{Request: &origRequest}
+
+	response, err := plugin.PollBinding(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusBadGateway))
+}
+
+func TestIstioPluginFetchBinding(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{CreatedServices: []*v1.Service{{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "svc-0-34234234234-43535-345345345", Namespace: mockNamespace},
+		Spec:       v1.ServiceSpec{ClusterIP: "10.0.0.1"}}}}
+	plugin := IstioPlugin{interceptor: ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}}
+	sourceEndpoint := model.Endpoint{Host: "host2", Port: 8888}
+	targetEndpoint := model.Endpoint{Host: "10.0.0.1", Port: 5555}
+	bindingBody, _ := json.Marshal(model.BindResponse{Endpoints: []model.Endpoint{sourceEndpoint},
+		NetworkData: model.NetworkDataResponse{
+			NetworkProfileId: "urn:local.test:public",
+			Data:             model.DataResponse{ProviderId: "provider", Endpoints: []model.Endpoint{sourceEndpoint}}}})
+	adaptBody, _ := json.Marshal(model.BindResponse{Endpoints: []model.Endpoint{targetEndpoint}})
+	nextHandler := SpyWebHandler{responseBody: bindingBody, adaptResponseBody: adaptBody}
+
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345")
+	origRequest := http.Request{URL: origURL, Method: http.MethodGet}
+	request := web.Request{Request: &origRequest}
+
+	response, err := plugin.FetchBinding(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusOK))
+	var bindResponse model.BindResponse
+	err = json.Unmarshal(response.Body, &bindResponse)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bindResponse.Endpoints).To(Equal([]model.Endpoint{targetEndpoint}))
+	g.Expect(bindResponse.NetworkData.Data.Endpoints).To(Equal([]model.Endpoint{sourceEndpoint}))
+
+	var adaptRequest model.AdaptCredentialsRequest
+	err = json.Unmarshal(nextHandler.requestBody, &adaptRequest)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(adaptRequest.EndpointMappings).To(Equal([]model.EndpointMapping{{Source: sourceEndpoint, Target: targetEndpoint}}))
+}
+
+func TestIstioPluginFetchBindingWithoutFetchInterceptor(t *testing.T) {
+	g := NewGomegaWithT(t)
+	plugin := IstioPlugin{interceptor: router.NoOpInterceptor{}}
+	nextHandler := SpyWebHandler{responseBody: []byte(`{"credentials": {"uri": "postgres://host2:8888"}}`)}
+
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345")
+	origRequest := http.Request{URL: origURL, Method: http.MethodGet}
+	request := web.Request{Request: &origRequest}
+
+	response, err := plugin.FetchBinding(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.Body).To(MatchJSON(`{"credentials": {"uri": "postgres://host2:8888"}}`))
+}
+
+func TestIstioPluginFetchBindingNotFound(t *testing.T) {
+	g := NewGomegaWithT(t)
+	plugin := IstioPlugin{interceptor: ConsumerInterceptor{ConfigStore: &MockConfigStore{}, NetworkProfile: "urn:local.test:public"}}
+	nextHandler := SpyWebHandler{statusCode: http.StatusNotFound, responseBody: []byte(`{"error": "NotFound", "description": "binding in progress"}`)}
+
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345")
+	origRequest := http.Request{URL: origURL, Method: http.MethodGet}
+	request := web.Request{Request: &origRequest}
+
+	response, err := plugin.FetchBinding(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+}
+
 func TestIstioPluginFetchCatalog(t *testing.T) {
 	g := NewGomegaWithT(t)
 
-	interceptor := router.ConsumerInterceptor{ServiceNamePrefix: "istio-"}
+	interceptor := ConsumerInterceptor{ServiceNamePrefix: "istio-"}
 	plugin := IstioPlugin{interceptor: &interceptor}
-	catalog := model.Catalog{[]model.Service{{Name: "istio-servicename"}}}
+	catalog := model.Catalog{Services: []model.Service{{Name: "istio-servicename"}}}
 
 	origURL, _ := url.Parse("http://host:80/v2/catalog")
 	origRequest := http.Request{URL: origURL, Method: http.MethodGet}
@@ -290,7 +536,7 @@ func TestIstioPluginFetchCatalog(t *testing.T) {
 func TestFailingFetchCatalog(t *testing.T) {
 	g := NewGomegaWithT(t)
 
-	interceptor := router.ConsumerInterceptor{ServiceNamePrefix: "istio-"}
+	interceptor := ConsumerInterceptor{ServiceNamePrefix: "istio-"}
 	plugin := IstioPlugin{interceptor: &interceptor}
 
 	origURL, _ := url.Parse("http://host:80/v2/catalog")
@@ -312,23 +558,60 @@ func TestFailingFetchCatalog(t *testing.T) {
 
 func TestCreateConsumerInterceptor(t *testing.T) {
 	g := NewGomegaWithT(t)
-	os.Setenv("ISTIO_SERVICE_NAME_PREFIX", "hello-")
-	os.Setenv("ISTIO_CONSUMER_ID", "myconsumer-id")
-	ci := createConsumerInterceptor(nil)
+	settings := &Settings{ServiceNamePrefix: "hello-", ConsumerId: "myconsumer-id", NetworkProfile: "urn:local.test:public"}
+	ci := createConsumerInterceptor(settings, nil)
 	g.Expect(ci.ConsumerId).To(Equal("myconsumer-id"))
 	g.Expect(ci.ServiceNamePrefix).To(Equal("hello-"))
+	g.Expect(ci.NetworkProfile).To(Equal("urn:local.test:public"))
+
+}
+
+func TestIstioPluginBindUsesInterceptorOfBroker(t *testing.T) {
+	g := NewGomegaWithT(t)
+	settings := &Settings{ConsumerId: "default-consumer", NetworkProfile: "urn:local.test:public",
+		Brokers: map[string]BrokerSettings{"Broker-A": {ConsumerId: "consumer-a"}}}
+	consumerInterceptor := createConsumerInterceptor(settings, &MockConfigStore{})
+	plugin := NewIstioPlugin(consumerInterceptor, createBrokerInterceptors(settings, consumerInterceptor), nil)
+
+	for brokerId, consumerId := range map[string]string{"broker-a": "consumer-a", "broker-b": "default-consumer"} {
+		nextHandler := SpyWebHandler{responseBody: []byte(`{}`)}
+		origURL, _ := url.Parse("http://host:80/v1/osb/" + brokerId + "/v2/service_instances/instance-id/service_bindings/bind-id")
+		request := web.Request{Request: &http.Request{URL: origURL, Method: http.MethodPut}, Body: []byte(`{}`)}
+
+		_, err := plugin.Bind(&request, &nextHandler)
+
+		g.Expect(err).NotTo(HaveOccurred())
+		var bindRequest model.BindRequest
+		g.Expect(json.Unmarshal(nextHandler.requestBody, &bindRequest)).To(Succeed())
+		g.Expect(bindRequest.NetworkData.Data.ConsumerId).To(Equal(consumerId))
+		g.Expect(bindRequest.NetworkData.NetworkProfileId).To(Equal("urn:local.test:public"))
+	}
+}
 
+func TestCreateBrokerInterceptors(t *testing.T) {
+	g := NewGomegaWithT(t)
+	settings := &Settings{ServiceNamePrefix: "istio-", ConsumerId: "consumer", NetworkProfile: "urn:local.test:public",
+		Brokers: map[string]BrokerSettings{"broker": {ServiceNamePrefix: "mesh-", NetworkProfile: "urn:local.test:private"}}}
+
+	interceptors := createBrokerInterceptors(settings, createConsumerInterceptor(settings, nil))
+
+	g.Expect(interceptors).To(HaveLen(1))
+	interceptor := interceptors["broker"].(ConsumerInterceptor)
+	g.Expect(interceptor.ServiceNamePrefix).To(Equal("mesh-"))
+	g.Expect(interceptor.ConsumerId).To(Equal("consumer"))
+	g.Expect(interceptor.NetworkProfile).To(Equal("urn:local.test:private"))
 }
 
 type SpyWebHandler struct {
-	url               url.URL
-	method            string
-	adaptResponseBody []byte
-	requestBody       []byte
-	responseBody      []byte
-	statusCode        int
-	requestHeaders    http.Header
-	err               error
+	url                       url.URL
+	method                    string
+	adaptResponseBody         []byte
+	lastOperationResponseBody []byte
+	requestBody               []byte
+	responseBody              []byte
+	statusCode                int
+	requestHeaders            http.Header
+	err                       error
 }
 
 func (s *SpyWebHandler) Handle(req *web.Request) (resp *web.Response, err error) {
@@ -342,6 +625,8 @@ func (s *SpyWebHandler) Handle(req *web.Request) (resp *web.Response, err error)
 	var responseBody []byte
 	if strings.HasSuffix(s.url.Path, "adapt_credentials") {
 		responseBody = s.adaptResponseBody
+	} else if strings.HasSuffix(s.url.Path, "last_operation") {
+		responseBody = s.lastOperationResponseBody
 	} else {
 		responseBody = s.responseBody
 	}
@@ -350,12 +635,26 @@ func (s *SpyWebHandler) Handle(req *web.Request) (resp *web.Response, err error)
 
 type SpyPostBindInterceptor struct {
 	router.NoOpInterceptor
-	bindId string
+	bindId  string
+	err     error
+	pending bool
+}
+
+func (s *SpyPostBindInterceptor) PostBindAccepted(request model.BindRequest, bindId string) error {
+	s.pending = true
+	return nil
+}
+
+func (s *SpyPostBindInterceptor) IsBindPending(bindId string) (bool, error) {
+	return s.pending, nil
 }
 
 func (s *SpyPostBindInterceptor) PostBind(request model.BindRequest, response model.BindResponse, bindingId string,
 	adapt func(model.Credentials, []model.EndpointMapping) (*model.BindResponse, error)) (*model.BindResponse, error) {
 	s.bindId = bindingId
+	if s.err != nil {
+		return nil, s.err
+	}
 	return &response, nil
 }
 
@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Peripli/service-manager/pkg/log"
+	"github.com/Peripli/service-manager/pkg/web"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	fieldOperation  = "operation"
+	fieldBrokerId   = "broker_id"
+	fieldInstanceId = "instance_id"
+	fieldBindingId  = "binding_id"
+)
+
+// logLevel overrides the level of the service manager logger for the log lines of the plugin, if set
+var logLevel *logrus.Level
+
+func setLogLevel(level string) error {
+	if level == "" {
+		logLevel = nil
+		return nil
+	}
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("Invalid log level %s: %s", level, err.Error())
+	}
+	logLevel = &parsed
+	return nil
+}
+
+// loggerFor returns the service manager logger of the context with the log level of the plugin
+func loggerFor(ctx context.Context) *logrus.Entry {
+	entry := log.C(ctx)
+	if logLevel != nil {
+		entry.Logger.Level = *logLevel
+	}
+	return entry
+}
+
+// withRequestLogger stores a logger with the operation, broker, instance and binding of the OSB request
+// in the request context, so that all log lines written while handling the request carry these fields
+func withRequestLogger(request *web.Request, operation string) *logrus.Entry {
+	ids := requestIdsOf(request)
+	entry := loggerFor(request.Context()).WithFields(logrus.Fields{
+		fieldOperation:  operation,
+		fieldBrokerId:   ids.BrokerId,
+		fieldInstanceId: ids.InstanceId,
+		fieldBindingId:  ids.BindingId,
+	})
+	request.Request = request.WithContext(log.ContextWithLogger(request.Context(), entry))
+	return entry
+}
+
+func pathSegmentAfter(path string, name string) string {
+	splitPath := strings.Split(path, "/")
+	for index, segment := range splitPath[:len(splitPath)-1] {
+		if segment == name {
+			return splitPath[index+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Peripli/service-manager/pkg/web"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+const bindingPath = "/v1/osb/broker-id/v2/service_instances/instance-id/service_bindings/bind-id"
+
+func TestWithRequestLoggerAddsFields(t *testing.T) {
+	g := NewGomegaWithT(t)
+	request := &web.Request{Request: httptest.NewRequest("PUT", bindingPath, nil)}
+
+	entry := withRequestLogger(request, operationBind)
+
+	g.Expect(entry.Data).To(HaveKeyWithValue(fieldOperation, operationBind))
+	g.Expect(entry.Data).To(HaveKeyWithValue(fieldBrokerId, "broker-id"))
+	g.Expect(entry.Data).To(HaveKeyWithValue(fieldInstanceId, "instance-id"))
+	g.Expect(entry.Data).To(HaveKeyWithValue(fieldBindingId, "bind-id"))
+	g.Expect(loggerFor(request.Context()).Data).To(HaveKeyWithValue(fieldBindingId, "bind-id"))
+}
+
+func TestInterceptorUsesRequestLogger(t *testing.T) {
+	g := NewGomegaWithT(t)
+	request := &web.Request{Request: httptest.NewRequest("PUT", bindingPath, nil)}
+	withRequestLogger(request, operationBind)
+
+	interceptor := ConsumerInterceptor{}.ForRequest(request, requestIdsOf(request)).(ConsumerInterceptor)
+
+	g.Expect(interceptor.logger().Data).To(HaveKeyWithValue(fieldOperation, operationBind))
+	g.Expect(interceptor.logger().Data).To(HaveKeyWithValue(fieldBindingId, "bind-id"))
+	g.Expect(ConsumerInterceptor{}.logger()).NotTo(BeNil())
+}
+
+func TestSetLogLevel(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer setLogLevel("")
+
+	err := setLogLevel("debug")
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(loggerFor(context.Background()).Logger.Level).To(Equal(logrus.DebugLevel))
+}
+
+func TestSetLogLevelInvalid(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer setLogLevel("")
+
+	err := setLogLevel("verbose")
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("verbose"))
+}
+
+func TestPathSegmentAfter(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(pathSegmentAfter(bindingPath, "osb")).To(Equal("broker-id"))
+	g.Expect(pathSegmentAfter(bindingPath, "service_bindings")).To(Equal("bind-id"))
+	g.Expect(pathSegmentAfter("/v2/catalog", "osb")).To(BeEmpty())
+}
@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"fmt"
+
+	"istio.io/api/networking/v1alpha3"
+	istioModel "istio.io/istio/pilot/pkg/model"
+)
+
+const (
+	defaultServicePort            = 5555
+	defaultEgressPort             = 9000
+	defaultClusterDomain          = "cluster.local"
+	defaultEgressGatewayService   = "istio-egressgateway"
+	defaultEgressGatewayNamespace = "istio-system"
+	defaultEgressGatewaySelector  = "istio=egressgateway"
+	// generatedEgressGatewayHost is the egress gateway host in the istio configs of the config generation
+	generatedEgressGatewayHost = "istio-egressgateway.istio-system.svc.cluster.local"
+)
+
+// MeshTopology describes the service mesh of the consumer cluster the generated objects route the traffic through
+type MeshTopology struct {
+	// ServicePort of the local services the applications connect to
+	ServicePort int32
+	// PreserveProviderPort gives the local services the port of the provider endpoint instead of ServicePort
+	PreserveProviderPort bool
+	// ServiceFQDN maps the endpoints to the fully qualified name of the local services instead of their cluster ip,
+	// so that the credentials stay valid if a service is recreated
+	ServiceFQDN bool
+	// ClusterDomain of the consumer cluster
+	ClusterDomain string
+	// EgressPort the egress gateway connects to at the provider
+	EgressPort int
+	// EgressGatewayHost is the fully qualified host of the egress gateway service
+	EgressGatewayHost string
+	// EgressGatewaySelector selects the pods of the egress gateway
+	EgressGatewaySelector map[string]string
+}
+
+// DefaultMeshTopology returns the topology of a default istio installation
+func DefaultMeshTopology() MeshTopology {
+	return MeshTopology{
+		ServicePort:           defaultServicePort,
+		ClusterDomain:         defaultClusterDomain,
+		EgressPort:            defaultEgressPort,
+		EgressGatewayHost:     serviceHost(defaultEgressGatewayService, defaultEgressGatewayNamespace, defaultClusterDomain),
+		EgressGatewaySelector: map[string]string{"istio": "egressgateway"},
+	}
+}
+
+// serviceHost returns the fully qualified name of the service
+func serviceHost(service string, namespace string, clusterDomain string) string {
+	return fmt.Sprintf("%s.%s.svc.%s", service, namespace, clusterDomain)
+}
+
+// withDefaults returns the topology with the values of the default topology for all values that are not set
+func (t MeshTopology) withDefaults() MeshTopology {
+	defaults := DefaultMeshTopology()
+	if t.ServicePort == 0 {
+		t.ServicePort = defaults.ServicePort
+	}
+	if t.ClusterDomain == "" {
+		t.ClusterDomain = defaults.ClusterDomain
+	}
+	if t.EgressPort == 0 {
+		t.EgressPort = defaults.EgressPort
+	}
+	if t.EgressGatewayHost == "" {
+		t.EgressGatewayHost = defaults.EgressGatewayHost
+	}
+	if len(t.EgressGatewaySelector) == 0 {
+		t.EgressGatewaySelector = defaults.EgressGatewaySelector
+	}
+	return t
+}
+
+// apply routes the generated istio config through the egress gateway of the topology. With ServiceFQDN, the mesh
+// virtual service matches the traffic to the given host of the local service instead of its cluster ip.
+func (t MeshTopology) apply(configuration istioModel.Config, host string) {
+	switch spec := configuration.Spec.(type) {
+	case *v1alpha3.VirtualService:
+		if t.ServiceFQDN && len(spec.Gateways) == 1 && spec.Gateways[0] == "mesh" {
+			spec.Hosts = []string{host}
+			for _, route := range spec.Tcp {
+				for _, match := range route.Match {
+					match.DestinationSubnets = nil
+				}
+			}
+		}
+		for _, route := range spec.Tcp {
+			for _, destination := range route.Route {
+				if destination.Destination != nil && destination.Destination.Host == generatedEgressGatewayHost {
+					destination.Destination.Host = t.EgressGatewayHost
+				}
+			}
+		}
+	case *v1alpha3.DestinationRule:
+		if spec.Host == generatedEgressGatewayHost {
+			spec.Host = t.EgressGatewayHost
+		}
+	case *v1alpha3.Gateway:
+		spec.Selector = make(map[string]string, len(t.EgressGatewaySelector))
+		for key, value := range t.EgressGatewaySelector {
+			spec.Selector[key] = value
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	. "github.com/onsi/gomega"
+	"istio.io/api/networking/v1alpha3"
+)
+
+func TestDefaultMeshTopologyMatchesGeneratedConfigs(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(DefaultMeshTopology().EgressGatewayHost).To(Equal(generatedEgressGatewayHost))
+}
+
+func TestConsumerInterceptorPostBindUsesMeshTopology(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public",
+		Topology: MeshTopology{ServicePort: 6666, EgressPort: 8443, EgressGatewayHost: "egress.mesh.svc.cluster.example.com",
+			EgressGatewaySelector: map[string]string{"app": "egress"}}}
+
+	binding, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 6666}}))
+	g.Expect(configStore.CreatedServices[0].Spec.Ports[0].Port).To(Equal(int32(6666)))
+	var gatewayHosts []string
+	for _, config := range configStore.CreatedIstioConfigs {
+		switch spec := config.Spec.(type) {
+		case *v1alpha3.ServiceEntry:
+			g.Expect(spec.Ports[0].Number).To(Equal(uint32(8443)))
+		case *v1alpha3.Gateway:
+			g.Expect(spec.Selector).To(Equal(map[string]string{"app": "egress"}))
+		case *v1alpha3.VirtualService:
+			for _, route := range spec.Tcp {
+				gatewayHosts = append(gatewayHosts, route.Route[0].Destination.Host)
+			}
+		case *v1alpha3.DestinationRule:
+			gatewayHosts = append(gatewayHosts, spec.Host)
+		}
+	}
+	g.Expect(gatewayHosts).To(ContainElement("egress.mesh.svc.cluster.example.com"))
+	g.Expect(gatewayHosts).NotTo(ContainElement(generatedEgressGatewayHost))
+}
+
+func TestConsumerInterceptorPostBindPreservesProviderPorts(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public",
+		Topology: MeshTopology{PreserveProviderPort: true}}
+	postgres := model.Endpoint{Host: "postgres.provider.example.com", Port: 5432}
+	rabbitmq := model.Endpoint{Host: "rabbitmq.provider.example.com", Port: 5672}
+
+	binding, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(postgres, rabbitmq), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 5432}, {Host: "10.0.0.1", Port: 5672}}))
+	ports := map[string]int32{}
+	for _, service := range configStore.CreatedServices {
+		ports[service.Name] = service.Spec.Ports[0].Port
+		g.Expect(service.Spec.Ports[0].TargetPort.IntValue()).To(Equal(int(service.Spec.Ports[0].Port)))
+	}
+	g.Expect(ports).To(Equal(map[string]int32{"svc-0-bind-id": 5432, "svc-1-bind-id": 5672}))
+
+	fetched, err := interceptor.PostFetchBinding(bindResponseWithEndpoints(postgres, rabbitmq), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(fetched.Endpoints).To(Equal(binding.Endpoints))
+}
+
+func TestBindingParametersPortTakesPrecedenceOverProviderPort(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public",
+		Topology: MeshTopology{PreserveProviderPort: true}}
+
+	binding, err := interceptor.PostBind(bindRequestWithParameters(`{"istio": {"port": 6000}}`), bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 6000}}))
+}
+
+func TestConsumerInterceptorPostBindMapsEndpointsToServiceFQDN(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public",
+		Topology: MeshTopology{ServiceFQDN: true, ClusterDomain: "cluster.example.com"}}
+
+	binding, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	fqdn := "svc-0-bind-id.catalog.svc.cluster.example.com"
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: fqdn, Port: 5555}}))
+	var meshServices []*v1alpha3.VirtualService
+	for _, config := range configStore.CreatedIstioConfigs {
+		if spec, ok := config.Spec.(*v1alpha3.VirtualService); ok && spec.Gateways[0] == "mesh" {
+			meshServices = append(meshServices, spec)
+		}
+	}
+	g.Expect(meshServices).To(HaveLen(1))
+	g.Expect(meshServices[0].Hosts).To(Equal([]string{fqdn}))
+	g.Expect(meshServices[0].Tcp[0].Match[0].DestinationSubnets).To(BeEmpty())
+
+	fetched, err := interceptor.PostFetchBinding(bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(fetched.Endpoints).To(Equal(binding.Endpoints))
+}
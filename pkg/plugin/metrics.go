@@ -0,0 +1,202 @@
+package plugin
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"github.com/Peripli/service-manager/pkg/web"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	istioModel "istio.io/istio/pilot/pkg/model"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	MetricsURL         = "/v1/monitor/istio/metrics"
+	metricsNamespace   = "istio_plugin"
+	serviceMetricsType = "service"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "osb_request_duration_seconds",
+		Help:      "Duration of the OSB operations intercepted by the plugin.",
+	}, []string{"operation", "status_code"})
+
+	objectsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "objects_created_total",
+		Help:      "Number of kubernetes services and istio configs created.",
+	}, []string{"type"})
+
+	objectsDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "objects_deleted_total",
+		Help:      "Number of kubernetes services and istio configs deleted.",
+	}, []string{"type"})
+
+	cleanupFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cleanup_failures_total",
+		Help:      "Number of clean ups that left objects of a binding behind.",
+	})
+
+	operationRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "retries_total",
+		Help:      "Number of kubernetes operations and unbinds at the broker retried after a transient error.",
+	}, []string{"operation"})
+
+	orphanedBindings = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphaned_bindings_total",
+		Help:      "Number of bindings that could not be added to the service mesh nor unbound at the broker.",
+	})
+
+	adaptCredentialsDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "adapt_credentials_duration_seconds",
+		Help:      "Duration of the adapt_credentials round-trips to the broker.",
+	}, []string{"status_code"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(requestDuration, objectsCreated, objectsDeleted, cleanupFailures, operationRetries, orphanedBindings, adaptCredentialsDuration)
+}
+
+func statusCodeLabel(response *web.Response, err error) string {
+	if err != nil {
+		return strconv.Itoa(model.HttpErrorFromError(err, http.StatusBadGateway).StatusCode)
+	}
+	return strconv.Itoa(response.StatusCode)
+}
+
+func observeRequest(operation string, start time.Time, response *web.Response, err error) (*web.Response, error) {
+	requestDuration.WithLabelValues(operation, statusCodeLabel(response, err)).Observe(time.Since(start).Seconds())
+	return response, err
+}
+
+func observeAdaptCredentials(adapt func(model.Credentials, []model.EndpointMapping) (*model.BindResponse, error)) func(model.Credentials, []model.EndpointMapping) (*model.BindResponse, error) {
+	return func(credentials model.Credentials, mappings []model.EndpointMapping) (*model.BindResponse, error) {
+		start := time.Now()
+		binding, err := adapt(credentials, mappings)
+		statusCode := http.StatusOK
+		if err != nil {
+			statusCode = model.HttpErrorFromError(err, http.StatusBadGateway).StatusCode
+		}
+		adaptCredentialsDuration.WithLabelValues(strconv.Itoa(statusCode)).Observe(time.Since(start).Seconds())
+		return binding, err
+	}
+}
+
+// instrumentedPlugin records the duration and outcome of every OSB operation of the wrapped plugin
+type instrumentedPlugin struct {
+	*IstioPlugin
+}
+
+func (p instrumentedPlugin) Bind(request *web.Request, next web.Handler) (*web.Response, error) {
+	start := time.Now()
+	response, err := p.IstioPlugin.Bind(request, next)
+	return observeRequest(operationBind, start, response, err)
+}
+
+func (p instrumentedPlugin) Unbind(request *web.Request, next web.Handler) (*web.Response, error) {
+	start := time.Now()
+	response, err := p.IstioPlugin.Unbind(request, next)
+	return observeRequest(operationUnbind, start, response, err)
+}
+
+func (p instrumentedPlugin) PollBinding(request *web.Request, next web.Handler) (*web.Response, error) {
+	start := time.Now()
+	response, err := p.IstioPlugin.PollBinding(request, next)
+	return observeRequest(operationPollBinding, start, response, err)
+}
+
+func (p instrumentedPlugin) FetchBinding(request *web.Request, next web.Handler) (*web.Response, error) {
+	start := time.Now()
+	response, err := p.IstioPlugin.FetchBinding(request, next)
+	return observeRequest(operationFetchBinding, start, response, err)
+}
+
+func (p instrumentedPlugin) FetchCatalog(request *web.Request, next web.Handler) (*web.Response, error) {
+	start := time.Now()
+	response, err := p.IstioPlugin.FetchCatalog(request, next)
+	return observeRequest(operationCatalog, start, response, err)
+}
+
+// instrumentedConfigStore counts the objects created and deleted through the wrapped store
+type instrumentedConfigStore struct {
+	ConfigStore
+}
+
+func (s instrumentedConfigStore) InNamespace(namespace string) ConfigStore {
+	return instrumentedConfigStore{s.ConfigStore.InNamespace(namespace)}
+}
+
+func (s instrumentedConfigStore) CreateService(service *v1.Service) (*v1.Service, error) {
+	service, err := s.ConfigStore.CreateService(service)
+	if err == nil {
+		objectsCreated.WithLabelValues(serviceMetricsType).Inc()
+	}
+	return service, err
+}
+
+func (s instrumentedConfigStore) CreateIstioConfig(config istioModel.Config) error {
+	err := s.ConfigStore.CreateIstioConfig(config)
+	if err == nil {
+		objectsCreated.WithLabelValues(config.Type).Inc()
+	}
+	return err
+}
+
+func (s instrumentedConfigStore) DeleteService(serviceName string) error {
+	err := s.ConfigStore.DeleteService(serviceName)
+	if err == nil {
+		objectsDeleted.WithLabelValues(serviceMetricsType).Inc()
+	}
+	return err
+}
+
+func (s instrumentedConfigStore) DeleteIstioConfig(configType string, configName string) error {
+	err := s.ConfigStore.DeleteIstioConfig(configType, configName)
+	if err == nil {
+		objectsDeleted.WithLabelValues(configType).Inc()
+	}
+	return err
+}
+
+// metricsController exposes the plugin metrics in the prometheus text format
+type metricsController struct {
+	gatherer prometheus.Gatherer
+}
+
+func (c metricsController) Routes() []web.Route {
+	return []web.Route{{
+		Endpoint: web.Endpoint{Method: http.MethodGet, Path: MetricsURL},
+		Handler:  c.metrics,
+	}}
+}
+
+func (c metricsController) metrics(request *web.Request) (*web.Response, error) {
+	families, err := c.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	encoder := expfmt.NewEncoder(&body, expfmt.FmtText)
+	for _, family := range families {
+		err = encoder.Encode(family)
+		if err != nil {
+			return nil, err
+		}
+	}
+	header := http.Header{}
+	header.Set("Content-Type", string(expfmt.FmtText))
+	return &web.Response{StatusCode: http.StatusOK, Header: header, Body: body.Bytes()}, nil
+}
@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"github.com/Peripli/service-manager/pkg/web"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(g *GomegaWithT, counter prometheus.Counter) float64 {
+	var metric dto.Metric
+	g.Expect(counter.Write(&metric)).To(Succeed())
+	return metric.GetCounter().GetValue()
+}
+
+func histogramCount(g *GomegaWithT, observer prometheus.Observer) uint64 {
+	var metric dto.Metric
+	g.Expect(observer.(prometheus.Metric).Write(&metric)).To(Succeed())
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestInstrumentedPluginObservesRequests(t *testing.T) {
+	g := NewGomegaWithT(t)
+	plugin := instrumentedPlugin{&IstioPlugin{interceptor: &SpyPostBindInterceptor{}}}
+	nextHandler := SpyWebHandler{statusCode: http.StatusForbidden}
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/3234234-234234-234234/service_bindings/34234234234-43535-345345345")
+	request := web.Request{Request: &http.Request{URL: origURL, Method: http.MethodDelete}}
+	before := histogramCount(g, requestDuration.WithLabelValues("unbind", "403"))
+
+	response, err := plugin.Unbind(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusForbidden))
+	g.Expect(histogramCount(g, requestDuration.WithLabelValues("unbind", "403"))).To(Equal(before + 1))
+}
+
+func TestInstrumentedPluginRegistration(t *testing.T) {
+	g := NewGomegaWithT(t)
+	api := web.API{}
+
+	api.RegisterPlugins(instrumentedPlugin{&IstioPlugin{}})
+
+	g.Expect(api.Filters).To(HaveLen(5))
+}
+
+func TestObserveAdaptCredentials(t *testing.T) {
+	g := NewGomegaWithT(t)
+	failing := func(model.Credentials, []model.EndpointMapping) (*model.BindResponse, error) {
+		return nil, &model.HttpError{StatusCode: http.StatusBadRequest, ErrorMsg: "invalid credentials"}
+	}
+	beforeOk := histogramCount(g, adaptCredentialsDuration.WithLabelValues("200"))
+	beforeFailed := histogramCount(g, adaptCredentialsDuration.WithLabelValues("400"))
+
+	_, err := observeAdaptCredentials(adaptEndpoints)(model.Credentials{}, []model.EndpointMapping{{}})
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = observeAdaptCredentials(failing)(model.Credentials{}, nil)
+	g.Expect(err).To(HaveOccurred())
+
+	g.Expect(histogramCount(g, adaptCredentialsDuration.WithLabelValues("200"))).To(Equal(beforeOk + 1))
+	g.Expect(histogramCount(g, adaptCredentialsDuration.WithLabelValues("400"))).To(Equal(beforeFailed + 1))
+}
+
+func TestInstrumentedConfigStoreCountsObjects(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := instrumentedConfigStore{&MockConfigStore{ClusterIp: "10.0.0.1"}}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	createdServices := counterValue(g, objectsCreated.WithLabelValues(serviceMetricsType))
+	createdGateways := counterValue(g, objectsCreated.WithLabelValues("gateway"))
+	deletedServices := counterValue(g, objectsDeleted.WithLabelValues(serviceMetricsType))
+
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	err = interceptor.PostDelete("bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(counterValue(g, objectsCreated.WithLabelValues(serviceMetricsType))).To(Equal(createdServices + 1))
+	g.Expect(counterValue(g, objectsCreated.WithLabelValues("gateway"))).To(Equal(createdGateways + 1))
+	g.Expect(counterValue(g, objectsDeleted.WithLabelValues(serviceMetricsType))).To(Equal(deletedServices + 1))
+}
+
+func TestCleanupFailuresAreCounted(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	configStore.DeleteServiceErr = errors.New("forbidden")
+	before := counterValue(g, cleanupFailures)
+
+	err = interceptor.PostDelete("bind-id")
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(counterValue(g, cleanupFailures)).To(Equal(before + 1))
+}
+
+func TestMetricsController(t *testing.T) {
+	g := NewGomegaWithT(t)
+	objectsCreated.WithLabelValues(serviceMetricsType).Add(0)
+	controller := metricsController{metricsRegistry}
+	routes := controller.Routes()
+	g.Expect(routes).To(HaveLen(1))
+	g.Expect(routes[0].Endpoint).To(Equal(web.Endpoint{Method: http.MethodGet, Path: "/v1/monitor/istio/metrics"}))
+
+	response, err := routes[0].Handler(&web.Request{})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusOK))
+	g.Expect(string(response.Body)).To(ContainSubstring(`istio_plugin_objects_created_total{type="service"}`))
+	g.Expect(response.Header.Get("Content-Type")).To(ContainSubstring("text/plain"))
+}
@@ -0,0 +1,301 @@
+package plugin
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	istioModel "istio.io/istio/pilot/pkg/model"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+type MockConfigStore struct {
+	CreatedServices      []*v1.Service
+	CreatedIstioConfigs  []istioModel.Config
+	ClusterIp            string
+	CreateServiceErr     error
+	CreateObjectErr      error
+	CreateObjectErrCount int
+	DeleteServiceErr     error
+	ListErr              error
+	DeletedServices      []string
+	DeletedIstioConfigs  []string
+	BindingRecords       map[string]BindingRecord
+	mutex                sync.Mutex
+}
+
+const mockNamespace = "catalog"
+
+// namespacedMockConfigStore is a view of the mock on the objects of another namespace
+type namespacedMockConfigStore struct {
+	*MockConfigStore
+	namespace string
+}
+
+func (m *MockConfigStore) InNamespace(namespace string) ConfigStore {
+	return namespacedMockConfigStore{m, namespace}
+}
+
+func (m *MockConfigStore) Namespace() string {
+	return mockNamespace
+}
+
+func (m *MockConfigStore) CreateService(service *v1.Service) (*v1.Service, error) {
+	return m.createService(mockNamespace, service)
+}
+
+func (m *MockConfigStore) GetService(serviceName string) (*v1.Service, error) {
+	return m.getService(mockNamespace, serviceName)
+}
+
+func (m *MockConfigStore) CreateIstioConfig(object istioModel.Config) error {
+	return m.createIstioConfig(object)
+}
+
+func (m *MockConfigStore) GetIstioConfig(configType string, configName string) (*istioModel.Config, error) {
+	return m.getIstioConfig(mockNamespace, configType, configName)
+}
+
+func (m *MockConfigStore) DeleteService(serviceName string) error {
+	return m.deleteService(mockNamespace, serviceName)
+}
+
+func (m *MockConfigStore) DeleteIstioConfig(configType string, configName string) error {
+	return m.deleteIstioConfig(mockNamespace, configType, configName)
+}
+
+func (m *MockConfigStore) ListServices(selector labels.Selector) ([]v1.Service, error) {
+	return m.listServices(mockNamespace, selector)
+}
+
+func (m *MockConfigStore) ListIstioConfigs(configType string, selector labels.Selector) ([]istioModel.Config, error) {
+	return m.listIstioConfigs(mockNamespace, configType, selector)
+}
+
+func (v namespacedMockConfigStore) Namespace() string {
+	return v.namespace
+}
+
+func (v namespacedMockConfigStore) CreateService(service *v1.Service) (*v1.Service, error) {
+	return v.createService(v.namespace, service)
+}
+
+func (v namespacedMockConfigStore) GetService(serviceName string) (*v1.Service, error) {
+	return v.getService(v.namespace, serviceName)
+}
+
+func (v namespacedMockConfigStore) GetIstioConfig(configType string, configName string) (*istioModel.Config, error) {
+	return v.getIstioConfig(v.namespace, configType, configName)
+}
+
+func (v namespacedMockConfigStore) DeleteService(serviceName string) error {
+	return v.deleteService(v.namespace, serviceName)
+}
+
+func (v namespacedMockConfigStore) DeleteIstioConfig(configType string, configName string) error {
+	return v.deleteIstioConfig(v.namespace, configType, configName)
+}
+
+func (v namespacedMockConfigStore) ListServices(selector labels.Selector) ([]v1.Service, error) {
+	return v.listServices(v.namespace, selector)
+}
+
+func (v namespacedMockConfigStore) ListIstioConfigs(configType string, selector labels.Selector) ([]istioModel.Config, error) {
+	return v.listIstioConfigs(v.namespace, configType, selector)
+}
+
+func (m *MockConfigStore) createService(namespace string, service *v1.Service) (*v1.Service, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.CreateServiceErr != nil {
+		return nil, m.CreateServiceErr
+	}
+	if err := assertBindingLabels(service.Name, service.Labels, service.Annotations); err != nil {
+		return nil, err
+	}
+	if errs := validation.IsDNS1035Label(service.Name); len(errs) != 0 {
+		return nil, errors.NewInvalid(schema.GroupKind{Kind: "Service"}, service.Name, nil)
+	}
+	for _, existing := range m.CreatedServices {
+		if existing.Namespace == namespace && existing.Name == service.Name {
+			return nil, errors.NewAlreadyExists(schema.GroupResource{Resource: "services"}, service.Name)
+		}
+	}
+	service.Namespace = namespace
+	m.CreatedServices = append(m.CreatedServices, service)
+	service.Spec.ClusterIP = m.ClusterIp
+	return service, nil
+}
+
+func (m *MockConfigStore) getService(namespace string, serviceName string) (*v1.Service, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, service := range m.CreatedServices {
+		if service.Namespace == namespace && service.Name == serviceName {
+			return service, nil
+		}
+	}
+	return nil, errors.NewNotFound(schema.GroupResource{Resource: "services"}, serviceName)
+}
+
+func (m *MockConfigStore) createIstioConfig(object istioModel.Config) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.CreateObjectErr != nil && m.CreateObjectErrCount == len(m.CreatedIstioConfigs) {
+		return m.CreateObjectErr
+	}
+	if err := assertBindingLabels(object.Name, object.Labels, object.Annotations); err != nil {
+		return err
+	}
+	if errs := validation.IsDNS1123Subdomain(object.Name); len(errs) != 0 {
+		return errors.NewInvalid(schema.GroupKind{Group: "networking.istio.io", Kind: object.Type}, object.Name, nil)
+	}
+	for _, existing := range m.CreatedIstioConfigs {
+		if existing.Namespace == object.Namespace && existing.Type == object.Type && existing.Name == object.Name {
+			return errors.NewAlreadyExists(schema.GroupResource{Group: "networking.istio.io", Resource: object.Type}, object.Name)
+		}
+	}
+	m.CreatedIstioConfigs = append(m.CreatedIstioConfigs, object)
+	return nil
+}
+
+func (m *MockConfigStore) getIstioConfig(namespace string, configType string, configName string) (*istioModel.Config, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, config := range m.CreatedIstioConfigs {
+		if config.Namespace == namespace && config.Type == configType && config.Name == configName {
+			return &config, nil
+		}
+	}
+	return nil, errors.NewNotFound(schema.GroupResource{Group: "networking.istio.io", Resource: configType}, configName)
+}
+
+func (m *MockConfigStore) deleteService(namespace string, serviceName string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.DeleteServiceErr != nil {
+		return m.DeleteServiceErr
+	}
+	for index, c := range m.CreatedServices {
+		if c.Namespace == namespace && c.Name == serviceName {
+			m.DeletedServices = append(m.DeletedServices, serviceName)
+			m.CreatedServices = append(m.CreatedServices[:index], m.CreatedServices[index+1:]...)
+			return nil
+		}
+	}
+	return errors.NewNotFound(schema.GroupResource{Resource: "services"}, serviceName)
+}
+
+func (m *MockConfigStore) deleteIstioConfig(namespace string, configType string, configName string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for index, c := range m.CreatedIstioConfigs {
+		if c.Namespace == namespace && c.Name == configName {
+			m.DeletedIstioConfigs = append(m.DeletedIstioConfigs, configType+":"+configName)
+			m.CreatedIstioConfigs = append(m.CreatedIstioConfigs[:index], m.CreatedIstioConfigs[index+1:]...)
+			return nil
+		}
+	}
+	return errors.NewNotFound(schema.GroupResource{Group: "networking.istio.io", Resource: configType}, configName)
+}
+
+func (m *MockConfigStore) listServices(namespace string, selector labels.Selector) ([]v1.Service, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.ListErr != nil {
+		return nil, m.ListErr
+	}
+	var result []v1.Service
+	for _, service := range m.CreatedServices {
+		if (namespace == meta_v1.NamespaceAll || service.Namespace == namespace) && selector.Matches(labels.Set(service.Labels)) {
+			result = append(result, *service)
+		}
+	}
+	return result, nil
+}
+
+func (m *MockConfigStore) listIstioConfigs(namespace string, configType string, selector labels.Selector) ([]istioModel.Config, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.ListErr != nil {
+		return nil, m.ListErr
+	}
+	var result []istioModel.Config
+	for _, config := range m.CreatedIstioConfigs {
+		if (namespace == meta_v1.NamespaceAll || config.Namespace == namespace) && config.Type == configType && selector.Matches(labels.Set(config.Labels)) {
+			result = append(result, config)
+		}
+	}
+	return result, nil
+}
+
+func (m *MockConfigStore) SaveBindingRecord(record BindingRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.BindingRecords == nil {
+		m.BindingRecords = make(map[string]BindingRecord)
+	}
+	record.Created = time.Now()
+	if existing, ok := m.BindingRecords[record.BindingId]; ok {
+		record.Created = existing.Created
+	}
+	m.BindingRecords[record.BindingId] = record
+	return nil
+}
+
+func (m *MockConfigStore) GetBindingRecord(bindId string) (*BindingRecord, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	record, ok := m.BindingRecords[bindId]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, bindingRecordName(bindId))
+	}
+	return &record, nil
+}
+
+func (m *MockConfigStore) ListBindingRecords() ([]BindingRecord, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var records []BindingRecord
+	for _, record := range m.BindingRecords {
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (m *MockConfigStore) DeleteBindingRecord(bindId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.BindingRecords[bindId]; !ok {
+		return errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, bindingRecordName(bindId))
+	}
+	delete(m.BindingRecords, bindId)
+	return nil
+}
+
+func assertBindingLabels(name string, objectLabels map[string]string, annotations map[string]string) error {
+	if objectLabels[managedByLabel] != managedByLabelValue || objectLabels[bindingIdKey] == "" {
+		return fmt.Errorf("object %s is not labelled with its binding: %v", name, objectLabels)
+	}
+	if bindingLabelValue(annotations[bindingIdKey]) != objectLabels[bindingIdKey] || annotations[pluginVersionKey] == "" {
+		return fmt.Errorf("object %s is not annotated with its binding: %v", name, annotations)
+	}
+	return nil
+}
+
+func (m *MockConfigStore) probeServices(namespace string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.ListErr
+}
+
+func (m *MockConfigStore) probeIstioConfigType(configType string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.ListErr
+}
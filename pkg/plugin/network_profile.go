@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+)
+
+// planMetadataKey is the key of the plan metadata in the catalog where a broker can announce
+// the network profile of the plan, e.g. "istio": {"network_profile": "urn:..."} or "istio": {"disabled": true}
+const planMetadataKey = "istio"
+
+// NetworkProfileRule selects the network profile for the bindings of a broker, service or plan.
+// Empty ids match all values. Disabled bindings bypass the service mesh.
+type NetworkProfileRule struct {
+	BrokerId       string `mapstructure:"broker_id" json:"-"`
+	ServiceId      string `mapstructure:"service_id" json:"-"`
+	PlanId         string `mapstructure:"plan_id" json:"-"`
+	NetworkProfile string `mapstructure:"network_profile" json:"network_profile"`
+	Disabled       bool   `mapstructure:"disabled" json:"disabled"`
+}
+
+// matches compares the broker ids case-insensitively like the keys of the broker settings
+func (r NetworkProfileRule) matches(brokerId string, serviceId string, planId string) bool {
+	return (r.BrokerId == "" || strings.EqualFold(r.BrokerId, brokerId)) &&
+		(r.ServiceId == "" || r.ServiceId == serviceId) &&
+		(r.PlanId == "" || r.PlanId == planId)
+}
+
+func (r NetworkProfileRule) validate() error {
+	if r.NetworkProfile == "" && !r.Disabled {
+		return fmt.Errorf("neither network_profile nor disabled set")
+	}
+	return nil
+}
+
+type planKey struct {
+	brokerId string
+	planId   string
+}
+
+// NetworkProfiles selects the network profile of a binding, first by the configured rules in their order
+// and then by the plan metadata of the last catalog fetched from the broker.
+type NetworkProfiles struct {
+	Rules []NetworkProfileRule
+	mutex sync.RWMutex
+	plans map[planKey]NetworkProfileRule
+}
+
+func NewNetworkProfiles(rules []NetworkProfileRule) *NetworkProfiles {
+	return &NetworkProfiles{Rules: rules, plans: make(map[planKey]NetworkProfileRule)}
+}
+
+// Select returns the rule for the bindings of the given plan and false if no rule applies
+func (p *NetworkProfiles) Select(brokerId string, serviceId string, planId string) (NetworkProfileRule, bool) {
+	for _, rule := range p.Rules {
+		if rule.matches(brokerId, serviceId, planId) {
+			return rule, true
+		}
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	rule, ok := p.plans[planKey{strings.ToLower(brokerId), planId}]
+	return rule, ok
+}
+
+// IsKnown returns true if bindings of any broker, service or plan might use the given network profile
+func (p *NetworkProfiles) IsKnown(profile string) bool {
+	for _, rule := range p.Rules {
+		if !rule.Disabled && rule.NetworkProfile == profile {
+			return true
+		}
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, rule := range p.plans {
+		if !rule.Disabled && rule.NetworkProfile == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// learnCatalog replaces the rules announced in the plan metadata of the broker.
+// Plans with invalid metadata are skipped and reported in the returned error.
+// The rules are only kept in memory, so they are unknown until the catalog is fetched through this process.
+func (p *NetworkProfiles) learnCatalog(brokerId string, catalog *model.Catalog) error {
+	brokerId = strings.ToLower(brokerId)
+	plans := make(map[planKey]NetworkProfileRule)
+	var lastErr error
+	for _, service := range catalog.Services {
+		for _, plan := range service.Plans {
+			raw, ok := plan.MetaData[planMetadataKey]
+			if !ok {
+				continue
+			}
+			var rule NetworkProfileRule
+			err := json.Unmarshal(raw, &rule)
+			if err == nil {
+				err = rule.validate()
+			}
+			planId := additionalString(plan.AdditionalProperties, "id")
+			if err != nil {
+				lastErr = fmt.Errorf("Invalid %s metadata of plan %s: %s", planMetadataKey, planId, err.Error())
+				continue
+			}
+			rule.BrokerId = brokerId
+			rule.ServiceId = additionalString(service.AdditionalProperties, "id")
+			rule.PlanId = planId
+			plans[planKey{brokerId, planId}] = rule
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key := range p.plans {
+		if key.brokerId == brokerId {
+			delete(p.plans, key)
+		}
+	}
+	for key, rule := range plans {
+		p.plans[key] = rule
+	}
+	return lastErr
+}
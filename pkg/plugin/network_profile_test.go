@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	. "github.com/onsi/gomega"
+)
+
+const catalogWithPlanMetadata = `{"services": [{"id": "postgres-id", "name": "postgres", "plans": [
+	{"id": "private-plan", "metadata": {"istio": {"network_profile": "urn:local.test:private"}}},
+	{"id": "direct-plan", "metadata": {"istio": {"disabled": true}}},
+	{"id": "invalid-plan", "metadata": {"istio": {}}},
+	{"id": "default-plan", "metadata": {}}]}]}`
+
+func catalogFromJSON(g *GomegaWithT, content string) *model.Catalog {
+	var catalog model.Catalog
+	g.Expect(json.Unmarshal([]byte(content), &catalog)).To(Succeed())
+	return &catalog
+}
+
+func TestNetworkProfilesSelectFirstMatchingRule(t *testing.T) {
+	g := NewGomegaWithT(t)
+	profiles := NewNetworkProfiles([]NetworkProfileRule{
+		{ServiceId: "postgres-id", PlanId: "small", Disabled: true},
+		{ServiceId: "postgres-id", NetworkProfile: "urn:local.test:private"},
+		{BrokerId: "broker", NetworkProfile: "urn:local.test:broker"},
+	})
+
+	rule, ok := profiles.Select("broker", "postgres-id", "small")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(rule.Disabled).To(BeTrue())
+
+	rule, ok = profiles.Select("broker", "postgres-id", "large")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(rule.NetworkProfile).To(Equal("urn:local.test:private"))
+
+	rule, ok = profiles.Select("broker", "rabbitmq-id", "large")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(rule.NetworkProfile).To(Equal("urn:local.test:broker"))
+
+	_, ok = profiles.Select("other-broker", "rabbitmq-id", "large")
+	g.Expect(ok).To(BeFalse())
+}
+
+func TestNetworkProfilesLearnCatalog(t *testing.T) {
+	g := NewGomegaWithT(t)
+	profiles := NewNetworkProfiles(nil)
+
+	err := profiles.learnCatalog("broker", catalogFromJSON(g, catalogWithPlanMetadata))
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("invalid-plan"))
+	rule, ok := profiles.Select("broker", "postgres-id", "private-plan")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(rule.NetworkProfile).To(Equal("urn:local.test:private"))
+	g.Expect(rule.ServiceId).To(Equal("postgres-id"))
+	rule, ok = profiles.Select("broker", "postgres-id", "direct-plan")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(rule.Disabled).To(BeTrue())
+	_, ok = profiles.Select("broker", "postgres-id", "default-plan")
+	g.Expect(ok).To(BeFalse())
+	_, ok = profiles.Select("other-broker", "postgres-id", "private-plan")
+	g.Expect(ok).To(BeFalse())
+	g.Expect(profiles.IsKnown("urn:local.test:private")).To(BeTrue())
+}
+
+func TestNetworkProfilesLearnCatalogReplacesPlansOfBroker(t *testing.T) {
+	g := NewGomegaWithT(t)
+	profiles := NewNetworkProfiles(nil)
+	profiles.learnCatalog("broker", catalogFromJSON(g, catalogWithPlanMetadata))
+	profiles.learnCatalog("other-broker", catalogFromJSON(g, catalogWithPlanMetadata))
+
+	err := profiles.learnCatalog("broker", &model.Catalog{})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	_, ok := profiles.Select("broker", "postgres-id", "private-plan")
+	g.Expect(ok).To(BeFalse())
+	_, ok = profiles.Select("other-broker", "postgres-id", "private-plan")
+	g.Expect(ok).To(BeTrue())
+}
+
+func TestNetworkProfilesRulesTakePrecedenceOverCatalog(t *testing.T) {
+	g := NewGomegaWithT(t)
+	profiles := NewNetworkProfiles([]NetworkProfileRule{{PlanId: "direct-plan", NetworkProfile: "urn:local.test:public"}})
+	profiles.learnCatalog("broker", catalogFromJSON(g, catalogWithPlanMetadata))
+
+	rule, ok := profiles.Select("broker", "postgres-id", "direct-plan")
+
+	g.Expect(ok).To(BeTrue())
+	g.Expect(rule.Disabled).To(BeFalse())
+	g.Expect(rule.NetworkProfile).To(Equal("urn:local.test:public"))
+}
+
+func TestNetworkProfilesCompareBrokerIdsCaseInsensitively(t *testing.T) {
+	g := NewGomegaWithT(t)
+	profiles := NewNetworkProfiles([]NetworkProfileRule{{BrokerId: "Legacy-Broker", Disabled: true}})
+	profiles.learnCatalog("Catalog-Broker", catalogFromJSON(g, catalogWithPlanMetadata))
+
+	rule, ok := profiles.Select("legacy-broker", "postgres-id", "large")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(rule.Disabled).To(BeTrue())
+
+	rule, ok = profiles.Select("catalog-broker", "postgres-id", "private-plan")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(rule.NetworkProfile).To(Equal("urn:local.test:private"))
+}
@@ -0,0 +1,70 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// maxServiceNameLength keeps the names of the istio configs, which prefix the service name with up to
+	// 20 characters, within the 63 characters of a DNS label
+	maxServiceNameLength = 43
+	nameHashLength       = 10
+)
+
+// boundedName returns prefix+id if it is valid and not longer than maxLength. Otherwise the id is lower-cased,
+// other characters than letters, digits and '-' are replaced with '-', and it is shortened so that a hash of the
+// original id fits behind it. Different ids therefore result in different names.
+func boundedName(prefix string, id string, maxLength int, validate func(string) []string) string {
+	name := prefix + id
+	if len(name) <= maxLength && len(validate(name)) == 0 {
+		return name
+	}
+	sum := sha256.Sum256([]byte(id))
+	hash := hex.EncodeToString(sum[:])[:nameHashLength]
+	normalized := strings.Map(func(r rune) rune {
+		r = unicode.ToLower(r)
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, id)
+	if room := maxLength - len(prefix) - len(hash) - 1; len(normalized) > room {
+		if room < 0 {
+			room = 0
+		}
+		normalized = normalized[:room]
+	}
+	normalized = strings.Trim(normalized, "-")
+	if normalized == "" {
+		return prefix + hash
+	}
+	return prefix + normalized + "-" + hash
+}
+
+// serviceName returns the name of the service for the endpoint with the given index, a DNS label that leaves
+// room for the prefixes of the istio configs
+func serviceName(index int, bindId string) string {
+	return boundedName(fmt.Sprintf("svc-%d-", index), bindId, maxServiceNameLength, validation.IsDNS1035Label)
+}
+
+// legacyServiceName is the name of the service for the endpoint with the given index before names were bounded.
+// Bindings without record may still have services with such names.
+func legacyServiceName(index int, bindId string) string {
+	return fmt.Sprintf("svc-%d-%s", index, bindId)
+}
+
+// bindingLabelValue returns the value of the binding id label, the full binding id is kept in the annotation
+func bindingLabelValue(bindId string) string {
+	return boundedName("", bindId, validation.LabelValueMaxLength, validation.IsValidLabelValue)
+}
+
+// subdomainName returns a name for objects like config maps and leases, whose names are DNS subdomains
+func subdomainName(prefix string, id string) string {
+	return boundedName(prefix, id, validation.DNS1123SubdomainMaxLength, validation.IsDNS1123Subdomain)
+}
@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/config"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestServiceNameKeepsValidBindingIds(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(serviceName(0, "bind-id")).To(Equal("svc-0-bind-id"))
+	g.Expect(serviceName(12, "0e9d7c5a-4a8e-4c3b-9f4e-2b6a1d8c7e3f")).To(Equal("svc-12-0e9d7c5a-4a8e-4c3b-9f4e-2b6a1d8c7e3f"))
+}
+
+func TestServiceNameBoundsAndNormalizesBindingIds(t *testing.T) {
+	g := NewGomegaWithT(t)
+	for _, bindId := range []string{
+		"0E9D7C5A-4A8E-4C3B-9F4E-2B6A1D8C7E3F",
+		"binding_id.with/other:characters",
+		strings.Repeat("long-binding-id-", 10),
+		"---",
+		"ÄÖÜ",
+	} {
+		for _, index := range []int{0, 1234} {
+			name := serviceName(index, bindId)
+
+			g.Expect(len(name)).To(BeNumerically("<=", maxServiceNameLength), bindId)
+			g.Expect(validation.IsDNS1035Label(name)).To(BeEmpty(), bindId)
+			for _, id := range config.DeleteEntriesForExternalServiceClient(name) {
+				g.Expect(validation.IsDNS1123Label(id.Name)).To(BeEmpty(), id.Name)
+			}
+		}
+	}
+}
+
+func TestServiceNamesOfDifferentBindingIdsDiffer(t *testing.T) {
+	g := NewGomegaWithT(t)
+	long := strings.Repeat("long-binding-id-", 10)
+
+	g.Expect(serviceName(0, "BIND-ID")).NotTo(Equal(serviceName(0, "bind-id")))
+	g.Expect(serviceName(0, "bind_id")).NotTo(Equal(serviceName(0, "bind.id")))
+	g.Expect(serviceName(0, long+"a")).NotTo(Equal(serviceName(0, long+"b")))
+	g.Expect(serviceName(0, long)).To(HavePrefix("svc-0-long-binding-id-"))
+}
+
+func TestBindingLabelValue(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(bindingLabelValue("Bind_ID.1")).To(Equal("Bind_ID.1"))
+	g.Expect(bindingLabelValue("")).To(BeEmpty())
+	for _, bindId := range []string{"bind/id", "-bind-id", strings.Repeat("a", 64)} {
+		g.Expect(validation.IsValidLabelValue(bindingLabelValue(bindId))).To(BeEmpty(), bindId)
+		g.Expect(bindingLabelValue(bindId)).NotTo(Equal(bindId))
+	}
+}
+
+func TestSubdomainNames(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(bindingRecordName("bind.id")).To(Equal("istio-binding-bind.id"))
+	g.Expect(bindingLeaseName("bind-id")).To(Equal("istio-binding-lock-bind-id"))
+	g.Expect(validation.IsDNS1123Subdomain(bindingRecordName("Bind_ID"))).To(BeEmpty())
+	g.Expect(validation.IsDNS1123Subdomain(bindingLeaseName(strings.Repeat("Bind_ID", 50)))).To(BeEmpty())
+}
@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"github.com/Peripli/service-manager/pkg/log"
+	"github.com/Peripli/service-manager/pkg/web"
+)
+
+const operationUnbindAtBroker = "unbind at broker"
+
+// isRetryableBrokerError returns true if an unbind at the broker may succeed when retried
+func isRetryableBrokerError(err error) bool {
+	httpError, ok := err.(*model.HttpError)
+	if !ok {
+		return true
+	}
+	return httpError.StatusCode >= http.StatusInternalServerError || httpError.StatusCode == http.StatusRequestTimeout ||
+		httpError.StatusCode == http.StatusTooManyRequests
+}
+
+// isGoneAtBroker returns true if the broker answered that the binding doesn't exist (anymore)
+func isGoneAtBroker(err error) bool {
+	httpError, ok := err.(*model.HttpError)
+	return ok && (httpError.StatusCode == http.StatusGone || httpError.StatusCode == http.StatusNotFound)
+}
+
+// mitigateOrphan unbinds a binding at the broker after it could not be added to the service mesh, so that it does
+// not stay orphaned at the broker. The unbind is retried with the orphan mitigation policy, even if the OSB request
+// was cancelled. Bindings that could not be unbound are logged and counted, bindings unknown to the broker are not.
+func (i *IstioPlugin) mitigateOrphan(request *web.Request, next web.Handler, bindingPath string, serviceId string, planId string, bindId string) {
+	if i.orphanMitigation == nil {
+		return
+	}
+	logger := loggerFor(request.Context())
+	ctx := log.ContextWithLogger(context.Background(), logger)
+	unbindURL := *request.URL
+	unbindURL.Path = bindingPath
+	query := url.Values{"accepts_incomplete": {"true"}}
+	if serviceId != "" {
+		query.Set("service_id", serviceId)
+	}
+	if planId != "" {
+		query.Set("plan_id", planId)
+	}
+	unbindURL.RawQuery = query.Encode()
+
+	logger.Infof("Unbinding %s at the broker as it could not be added to the service mesh", bindId)
+	err := i.orphanMitigation.doWhile(ctx, operationUnbindAtBroker, isRetryableBrokerError, func() error {
+		unbindRequest := &web.Request{Request: request.Request.WithContext(ctx)}
+		unbindRequest.URL = &unbindURL
+		peripliContext := &PeripliContext{request: unbindRequest, next: next}
+		return peripliContext.Delete().Do().Error()
+	})
+	if isGoneAtBroker(err) {
+		logger.Infof("Binding %s is already gone at the broker", bindId)
+		return
+	}
+	if err != nil {
+		orphanedBindings.Inc()
+		logger.Errorf("Binding %s is orphaned at the broker, it could not be unbound: %s", bindId, err.Error())
+		return
+	}
+	logger.Infof("Unbound %s at the broker", bindId)
+}
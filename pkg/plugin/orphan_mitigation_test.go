@@ -0,0 +1,190 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"github.com/Peripli/service-manager/pkg/web"
+	. "github.com/onsi/gomega"
+)
+
+var testOrphanMitigation = &RetryPolicy{MaxAttempts: 3, InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Timeout: time.Second}
+
+// brokerStub answers binds with bindStatus and unbinds with the next of unbindStatus, or 200 if none is left
+type brokerStub struct {
+	bindStatus   int
+	unbindStatus []int
+	unbinds      []url.URL
+	mutex        sync.Mutex
+}
+
+func (b *brokerStub) Handle(request *web.Request) (*web.Response, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if request.Method != http.MethodDelete {
+		return &web.Response{StatusCode: b.bindStatus, Body: []byte(`{"credentials": {}}`)}, nil
+	}
+	b.unbinds = append(b.unbinds, *request.URL)
+	status := http.StatusOK
+	if len(b.unbindStatus) > 0 {
+		status = b.unbindStatus[0]
+		b.unbindStatus = b.unbindStatus[1:]
+	}
+	return &web.Response{StatusCode: status, Body: []byte(`{}`)}, nil
+}
+
+func bindWithFailingPostBind(g *GomegaWithT, broker *brokerStub, orphanMitigation *RetryPolicy) *web.Response {
+	plugin := IstioPlugin{interceptor: &SpyPostBindInterceptor{err: errors.New("mesh failed")}, orphanMitigation: orphanMitigation}
+	origURL, _ := url.Parse("http://host:80/v1/osb/broker-id/v2/service_instances/instance-id/service_bindings/bind-id?accepts_incomplete=true")
+	request := web.Request{Request: &http.Request{URL: origURL, Method: http.MethodPut, Header: http.Header{}}}
+	request.Body, _ = json.Marshal(map[string]string{"service_id": "service", "plan_id": "plan"})
+
+	response, err := plugin.Bind(&request, broker)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.StatusCode).To(Equal(http.StatusBadGateway))
+	return response
+}
+
+func TestIstioPluginBindUnbindsAtBrokerIfPostBindFails(t *testing.T) {
+	g := NewGomegaWithT(t)
+	broker := &brokerStub{bindStatus: http.StatusCreated}
+
+	bindWithFailingPostBind(g, broker, testOrphanMitigation)
+
+	g.Expect(broker.unbinds).To(HaveLen(1))
+	g.Expect(broker.unbinds[0].Path).To(Equal("/v1/osb/broker-id/v2/service_instances/instance-id/service_bindings/bind-id"))
+	g.Expect(broker.unbinds[0].Query()).To(Equal(url.Values{
+		"service_id": {"service"}, "plan_id": {"plan"}, "accepts_incomplete": {"true"}}))
+}
+
+func TestIstioPluginBindKeepsExistingBindingAtBroker(t *testing.T) {
+	g := NewGomegaWithT(t)
+	broker := &brokerStub{bindStatus: http.StatusOK}
+
+	bindWithFailingPostBind(g, broker, testOrphanMitigation)
+
+	g.Expect(broker.unbinds).To(BeEmpty())
+}
+
+func TestIstioPluginBindWithoutOrphanMitigation(t *testing.T) {
+	g := NewGomegaWithT(t)
+	broker := &brokerStub{bindStatus: http.StatusCreated}
+
+	bindWithFailingPostBind(g, broker, nil)
+
+	g.Expect(broker.unbinds).To(BeEmpty())
+}
+
+func TestIstioPluginBindRetriesUnbindAtBroker(t *testing.T) {
+	g := NewGomegaWithT(t)
+	broker := &brokerStub{bindStatus: http.StatusCreated, unbindStatus: []int{http.StatusServiceUnavailable, http.StatusInternalServerError}}
+	orphaned := counterValue(g, orphanedBindings)
+
+	bindWithFailingPostBind(g, broker, testOrphanMitigation)
+
+	g.Expect(broker.unbinds).To(HaveLen(3))
+	g.Expect(counterValue(g, orphanedBindings)).To(Equal(orphaned))
+}
+
+func TestIstioPluginBindRecordsOrphanedBinding(t *testing.T) {
+	g := NewGomegaWithT(t)
+	broker := &brokerStub{bindStatus: http.StatusCreated, unbindStatus: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusOK}}
+	orphaned := counterValue(g, orphanedBindings)
+
+	bindWithFailingPostBind(g, broker, testOrphanMitigation)
+
+	g.Expect(broker.unbinds).To(HaveLen(testOrphanMitigation.MaxAttempts))
+	g.Expect(counterValue(g, orphanedBindings)).To(Equal(orphaned + 1))
+}
+
+func TestIstioPluginBindDoesNotRetryRejectedUnbind(t *testing.T) {
+	g := NewGomegaWithT(t)
+	broker := &brokerStub{bindStatus: http.StatusCreated, unbindStatus: []int{http.StatusBadRequest}}
+	orphaned := counterValue(g, orphanedBindings)
+
+	bindWithFailingPostBind(g, broker, testOrphanMitigation)
+
+	g.Expect(broker.unbinds).To(HaveLen(1))
+	g.Expect(counterValue(g, orphanedBindings)).To(Equal(orphaned + 1))
+}
+
+func TestIstioPluginBindAcceptsGoneBinding(t *testing.T) {
+	g := NewGomegaWithT(t)
+	broker := &brokerStub{bindStatus: http.StatusCreated, unbindStatus: []int{http.StatusGone}}
+	orphaned := counterValue(g, orphanedBindings)
+
+	bindWithFailingPostBind(g, broker, testOrphanMitigation)
+
+	g.Expect(broker.unbinds).To(HaveLen(1))
+	g.Expect(counterValue(g, orphanedBindings)).To(Equal(orphaned))
+}
+
+func TestIstioPluginBindAcceptsBindingNotFound(t *testing.T) {
+	g := NewGomegaWithT(t)
+	broker := &brokerStub{bindStatus: http.StatusCreated, unbindStatus: []int{http.StatusNotFound}}
+	orphaned := counterValue(g, orphanedBindings)
+
+	bindWithFailingPostBind(g, broker, testOrphanMitigation)
+
+	g.Expect(broker.unbinds).To(HaveLen(1))
+	g.Expect(counterValue(g, orphanedBindings)).To(Equal(orphaned))
+}
+
+func TestIstioPluginPollBindingKeepsBindingThatCanNotBeFetched(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := &SpyPostBindInterceptor{pending: true}
+	plugin := IstioPlugin{interceptor: interceptor, orphanMitigation: testOrphanMitigation}
+	var methods []string
+	broker := web.HandlerFunc(func(request *web.Request) (*web.Response, error) {
+		methods = append(methods, request.Method)
+		if strings.HasSuffix(request.URL.Path, lastOperationPath) {
+			return &web.Response{StatusCode: http.StatusOK, Body: []byte(`{"state": "succeeded"}`)}, nil
+		}
+		return &web.Response{StatusCode: http.StatusNotFound, Body: []byte(`{}`)}, nil
+	})
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/instance-id/service_bindings/bind-id/last_operation?operation=task-1")
+	orphaned := counterValue(g, orphanedBindings)
+
+	response, err := plugin.PollBinding(&web.Request{Request: &http.Request{URL: origURL, Method: http.MethodGet}}, broker)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.Body).To(ContainSubstring(`"failed"`))
+	g.Expect(methods).To(Equal([]string{http.MethodGet, http.MethodGet}))
+	g.Expect(interceptor.bindId).To(BeEmpty())
+	g.Expect(counterValue(g, orphanedBindings)).To(Equal(orphaned))
+}
+
+func TestIstioPluginPollBindingUnbindsAtBrokerIfPostBindFails(t *testing.T) {
+	g := NewGomegaWithT(t)
+	plugin := IstioPlugin{interceptor: &SpyPostBindInterceptor{err: errors.New("mesh failed"), pending: true}, orphanMitigation: testOrphanMitigation}
+	nextHandler := SpyWebHandler{lastOperationResponseBody: []byte(`{"state": "succeeded"}`), responseBody: []byte(`{}`)}
+	origURL, _ := url.Parse("http://host:80/v2/service_instances/instance-id/service_bindings/bind-id/last_operation?operation=task-1&service_id=service&plan_id=plan")
+	request := web.Request{Request: &http.Request{URL: origURL, Method: http.MethodGet}}
+
+	response, err := plugin.PollBinding(&request, &nextHandler)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(response.Body).To(ContainSubstring(`"failed"`))
+	g.Expect(nextHandler.method).To(Equal(http.MethodDelete))
+	g.Expect(nextHandler.url.Path).To(Equal("/v2/service_instances/instance-id/service_bindings/bind-id"))
+	g.Expect(nextHandler.url.Query()).To(Equal(url.Values{
+		"service_id": {"service"}, "plan_id": {"plan"}, "accepts_incomplete": {"true"}}))
+}
+
+func TestIsRetryableBrokerError(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(isRetryableBrokerError(errors.New("connection refused"))).To(BeTrue())
+	g.Expect(isRetryableBrokerError(&model.HttpError{StatusCode: http.StatusBadGateway})).To(BeTrue())
+	g.Expect(isRetryableBrokerError(&model.HttpError{StatusCode: http.StatusTooManyRequests})).To(BeTrue())
+	g.Expect(isRetryableBrokerError(&model.HttpError{StatusCode: http.StatusUnprocessableEntity})).To(BeFalse())
+	g.Expect(isRetryableBrokerError(&model.HttpError{StatusCode: http.StatusBadRequest})).To(BeFalse())
+}
@@ -0,0 +1,50 @@
+package plugin
+
+import "sync"
+
+// boundedGroup runs tasks concurrently, at most limit at a time. Tasks may add further tasks to the group.
+// After a task failed, tasks that did not start yet are skipped.
+type boundedGroup struct {
+	slots     chan struct{}
+	waitGroup sync.WaitGroup
+	mutex     sync.Mutex
+	err       error
+}
+
+func newBoundedGroup(limit int) *boundedGroup {
+	if limit < 1 {
+		limit = 1
+	}
+	return &boundedGroup{slots: make(chan struct{}, limit)}
+}
+
+func (g *boundedGroup) Go(task func() error) {
+	g.waitGroup.Add(1)
+	go func() {
+		defer g.waitGroup.Done()
+		g.slots <- struct{}{}
+		defer func() { <-g.slots }()
+		if g.failed() {
+			return
+		}
+		if err := task(); err != nil {
+			g.mutex.Lock()
+			defer g.mutex.Unlock()
+			if g.err == nil {
+				g.err = err
+			}
+		}
+	}()
+}
+
+func (g *boundedGroup) failed() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.err != nil
+}
+
+// Wait blocks until all tasks finished and returns the error of the first task that failed
+func (g *boundedGroup) Wait() error {
+	g.waitGroup.Wait()
+	return g.err
+}
@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// concurrencyTracker records the maximum number of calls running at the same time. The calls are held until
+// the expected number of them runs at the same time, so that reaching it doesn't depend on timing.
+type concurrencyTracker struct {
+	mutex    sync.Mutex
+	running  int
+	max      int
+	expected int
+	released chan struct{}
+}
+
+func newConcurrencyTracker(expected int) *concurrencyTracker {
+	return &concurrencyTracker{expected: expected, released: make(chan struct{})}
+}
+
+func (c *concurrencyTracker) track() {
+	c.mutex.Lock()
+	c.running++
+	if c.running > c.max {
+		c.max = c.running
+		if c.max == c.expected {
+			close(c.released)
+		}
+	}
+	c.mutex.Unlock()
+	select {
+	case <-c.released:
+	case <-time.After(10 * time.Second):
+		// the expected number is never reached, maxRunning reports the lower number
+	}
+	c.mutex.Lock()
+	c.running--
+	c.mutex.Unlock()
+}
+
+func (c *concurrencyTracker) maxRunning() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.max
+}
+
+func TestBoundedGroupLimitsParallelism(t *testing.T) {
+	g := NewGomegaWithT(t)
+	tracker := newConcurrencyTracker(3)
+	group := newBoundedGroup(3)
+
+	for i := 0; i < 12; i++ {
+		group.Go(func() error {
+			tracker.track()
+			return nil
+		})
+	}
+
+	g.Expect(group.Wait()).To(Succeed())
+	g.Expect(tracker.maxRunning()).To(Equal(3))
+}
+
+func TestBoundedGroupRunsNestedTasks(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var mutex sync.Mutex
+	var done []string
+	group := newBoundedGroup(1)
+
+	group.Go(func() error {
+		group.Go(func() error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			done = append(done, "nested")
+			return nil
+		})
+		return nil
+	})
+
+	g.Expect(group.Wait()).To(Succeed())
+	g.Expect(done).To(Equal([]string{"nested"}))
+}
+
+func TestBoundedGroupSkipsTasksAfterError(t *testing.T) {
+	g := NewGomegaWithT(t)
+	group := newBoundedGroup(1)
+	started := 0
+
+	group.Go(func() error {
+		started++
+		for i := 0; i < 5; i++ {
+			group.Go(func() error {
+				started++
+				return nil
+			})
+		}
+		return errors.New("failed")
+	})
+
+	g.Expect(group.Wait()).To(MatchError("failed"))
+	g.Expect(started).To(Equal(1))
+}
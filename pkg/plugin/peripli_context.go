@@ -1,12 +1,12 @@
 package plugin
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/Peripli/istio-broker-proxy/pkg/model"
 	"github.com/Peripli/istio-broker-proxy/pkg/router"
 	"github.com/Peripli/service-manager/pkg/web"
-	"log"
 	"net/http"
 )
 
@@ -17,6 +17,13 @@ type PeripliContext struct {
 	err      error
 }
 
+func (client *PeripliContext) context() context.Context {
+	if client.request == nil {
+		return context.Background()
+	}
+	return client.request.Context()
+}
+
 type PeripliRestRequest struct {
 	*PeripliContext
 }
@@ -76,7 +83,7 @@ func (o *PeripliRestResponse) Into(result interface{}) error {
 
 	if nil != o.err {
 		o.err = fmt.Errorf("Can't unmarshal response from %s: %s", o.request.URL.String(), o.err.Error())
-		log.Printf("ERROR: %s\n", o.err.Error())
+		loggerFor(o.context()).Error(o.err.Error())
 		return o.err
 	}
 	return nil
@@ -88,12 +95,12 @@ func (o *PeripliRestResponse) Error() error {
 
 func (o *PeripliContext) JSON(result interface{}, err error) (*web.Response, error) {
 	if err != nil {
-		return httpError(err, http.StatusBadGateway)
+		return httpError(o.context(), err, http.StatusBadGateway)
 	}
 	if result != nil {
 		o.response.Body, err = json.Marshal(result)
 		if err != nil {
-			return httpError(err, http.StatusInternalServerError)
+			return httpError(o.context(), err, http.StatusInternalServerError)
 		}
 	}
 	return o.response, nil
@@ -0,0 +1,294 @@
+package plugin
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BindingSource returns the ids of the bindings that are still alive
+type BindingSource interface {
+	BindingIds() (map[string]bool, error)
+}
+
+// recordBindingSource treats every binding with a record as alive, unless the record is pending clean up.
+// The plugin can't ask the Service Manager or the broker which bindings exist, so a binding that is removed
+// without an unbind through the proxy keeps its record and objects until the record is deleted.
+type recordBindingSource struct {
+	configStore ConfigStore
+}
+
+func (s recordBindingSource) BindingIds() (map[string]bool, error) {
+	records, err := s.configStore.ListBindingRecords()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]bool)
+	for _, record := range records {
+		if !record.PendingCleanup {
+			result[record.BindingId] = true
+		}
+	}
+	return result, nil
+}
+
+// Reconciler periodically removes services and istio configs generated by the plugin whose binding is gone,
+// e.g. after a failed unbind or a crash during bind. In dry-run mode the orphans are only reported.
+type Reconciler struct {
+	ConfigStore ConfigStore
+	Bindings    BindingSource
+	Interval    time.Duration
+	DryRun      bool
+	// Namespaces checked for orphans besides the namespace of the plugin and the target namespaces of the recorded bindings
+	Namespaces []string
+	// AllNamespaces checks all namespaces for orphans, as target namespaces derived per binding are not known
+	AllNamespaces bool
+	// AsyncBindTimeout is the time after which the record of an asynchronous bind without objects is removed,
+	// as its bind failed or was never polled. Zero keeps such records.
+	AsyncBindTimeout time.Duration
+	// Lock serializes the removal of records with the operations on their binding, if set
+	Lock BindingLock
+}
+
+func NewReconciler(configStore ConfigStore, interval time.Duration, dryRun bool) *Reconciler {
+	return &Reconciler{ConfigStore: configStore, Bindings: recordBindingSource{configStore}, Interval: interval, DryRun: dryRun}
+}
+
+// Start runs the reconciliation every interval until stop is closed. A zero interval disables the reconciler.
+func (r *Reconciler) Start(stop <-chan struct{}) {
+	logger := loggerFor(context.Background())
+	if r.Interval <= 0 {
+		logger.Info("Reconciler disabled")
+		return
+	}
+	logger.Infof("Reconciler starting with interval=%s dry_run=%t", r.Interval, r.DryRun)
+	go func() {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := r.Reconcile()
+				if err != nil {
+					logger.Errorf("Reconciler failed: %s", err.Error())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Reconcile removes, or in dry-run mode only reports, all orphaned objects and returns them grouped by binding.
+// The objects are listed before the bindings are read: a bind records its objects before creating them, so the
+// objects of a bind in progress always belong to a binding that is read as alive.
+func (r *Reconciler) Reconcile() ([]BindingRecord, error) {
+	objects, err := r.findObjects()
+	if err != nil {
+		return nil, err
+	}
+	alive, err := r.Bindings.BindingIds()
+	if err != nil {
+		return nil, err
+	}
+	var orphans []BindingRecord
+	for _, binding := range objects {
+		if !alive[binding.BindingId] {
+			orphans = append(orphans, binding)
+		}
+	}
+	var lastErr error
+	for _, orphan := range orphans {
+		logger := loggerFor(context.Background()).WithField(fieldBindingId, orphan.BindingId)
+		if r.DryRun {
+			logger.Infof("Reconciler found orphaned objects of binding %s: %s", orphan.BindingId, orphan)
+			continue
+		}
+		logger.Infof("Reconciler removing orphaned objects of binding %s: %s", orphan.BindingId, orphan)
+		_, err = removeBindingObjects(r.objectStore(orphan.Namespace), orphan)
+		if err != nil {
+			logger.Error(err.Error())
+			lastErr = err
+		}
+	}
+	if err := r.removeStaleRecords(); err != nil {
+		lastErr = err
+	}
+	return orphans, lastErr
+}
+
+// removeStaleRecords removes the objects left by failed unbinds and rollbacks, which may not be labelled,
+// and then their records, as well as the records of abandoned asynchronous binds
+func (r *Reconciler) removeStaleRecords() error {
+	records, err := r.ConfigStore.ListBindingRecords()
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, record := range records {
+		if !r.isStale(record) {
+			continue
+		}
+		logger := loggerFor(context.Background()).WithField(fieldBindingId, record.BindingId)
+		if r.DryRun {
+			logger.Infof("Reconciler found stale record of binding %s: %s", record.BindingId, record)
+			continue
+		}
+		err = r.removeStaleRecord(record.BindingId)
+		if err != nil && !errors.IsNotFound(err) {
+			logger.Error(err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// isStale returns true for records pending clean up and for records of asynchronous binds without objects that
+// were accepted longer than AsyncBindTimeout ago
+func (r *Reconciler) isStale(record BindingRecord) bool {
+	if record.PendingCleanup {
+		return true
+	}
+	return r.AsyncBindTimeout > 0 && record.isEmpty() && !record.Created.IsZero() &&
+		time.Since(record.Created) > r.AsyncBindTimeout
+}
+
+// removeStaleRecord removes the record and its objects while holding the lock of the binding, if the record is
+// still stale then, e.g. an asynchronous bind was not polled in the meantime
+func (r *Reconciler) removeStaleRecord(bindId string) error {
+	if r.Lock != nil {
+		unlock, err := r.Lock.Lock(context.Background(), bindId)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	record, err := r.ConfigStore.GetBindingRecord(bindId)
+	if err != nil || !r.isStale(*record) {
+		return err
+	}
+	loggerFor(context.Background()).WithField(fieldBindingId, bindId).Infof("Reconciler removing stale record of binding %s: %s", bindId, record)
+	_, err = removeBindingObjects(r.objectStore(record.Namespace), *record)
+	if err != nil {
+		return err
+	}
+	return r.ConfigStore.DeleteBindingRecord(bindId)
+}
+
+// namespaces returns the namespaces that might contain objects of the plugin: its own, the configured ones
+// and the target namespaces of all recorded bindings. The namespace of the plugin is represented by "".
+func (r *Reconciler) namespaces() ([]string, error) {
+	records, err := r.ConfigStore.ListBindingRecords()
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]bool{"": true}
+	for _, namespace := range r.Namespaces {
+		found[namespace] = true
+	}
+	for _, record := range records {
+		found[record.Namespace] = true
+	}
+	delete(found, r.ConfigStore.Namespace())
+	var namespaces []string
+	for namespace := range found {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+func (r *Reconciler) objectStore(namespace string) ConfigStore {
+	if namespace == "" {
+		return r.ConfigStore
+	}
+	return r.ConfigStore.InNamespace(namespace)
+}
+
+// findObjects returns all objects generated by the plugin, grouped by binding and namespace
+func (r *Reconciler) findObjects() ([]BindingRecord, error) {
+	var stores []ConfigStore
+	if r.AllNamespaces {
+		stores = append(stores, r.ConfigStore.InNamespace(meta_v1.NamespaceAll))
+	} else {
+		namespaces, err := r.namespaces()
+		if err != nil {
+			return nil, err
+		}
+		for _, namespace := range namespaces {
+			stores = append(stores, r.objectStore(namespace))
+		}
+	}
+	var result []BindingRecord
+	for _, configStore := range stores {
+		objects, err := r.findObjectsIn(configStore)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, objects...)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].BindingId != result[j].BindingId {
+			return result[i].BindingId < result[j].BindingId
+		}
+		return result[i].Namespace < result[j].Namespace
+	})
+	return result, nil
+}
+
+// findObjectsIn groups the objects of the store labeled as managed by the plugin by binding and by their namespace
+func (r *Reconciler) findObjectsIn(configStore ConfigStore) ([]BindingRecord, error) {
+	type bindingKey struct {
+		bindId    string
+		namespace string
+	}
+	bindings := make(map[bindingKey]*BindingRecord)
+	// the annotation has the full binding id, the label may be hashed
+	bindingOf := func(namespace string, labels map[string]string, annotations map[string]string) *BindingRecord {
+		bindId := annotations[bindingIdKey]
+		if bindId == "" {
+			bindId = labels[bindingIdKey]
+		}
+		if bindId == "" {
+			return nil
+		}
+		if namespace == r.ConfigStore.Namespace() {
+			namespace = ""
+		}
+		key := bindingKey{bindId, namespace}
+		if bindings[key] == nil {
+			bindings[key] = &BindingRecord{BindingId: bindId, Namespace: namespace}
+		}
+		return bindings[key]
+	}
+
+	services, err := configStore.ListServices(ManagedSelector())
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		if binding := bindingOf(service.Namespace, service.Labels, service.Annotations); binding != nil {
+			binding.Services = append(binding.Services, service.Name)
+		}
+	}
+	for _, configType := range istioConfigTypes {
+		configs, err := configStore.ListIstioConfigs(configType, ManagedSelector())
+		if err != nil {
+			return nil, err
+		}
+		for _, config := range configs {
+			if binding := bindingOf(config.Namespace, config.Labels, config.Annotations); binding != nil {
+				binding.IstioConfigs = append(binding.IstioConfigs, IstioConfigRef{Type: config.Type, Name: config.Name})
+			}
+		}
+	}
+
+	var result []BindingRecord
+	for _, binding := range bindings {
+		result = append(result, *binding)
+	}
+	return result, nil
+}
@@ -0,0 +1,181 @@
+package plugin
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	. "github.com/onsi/gomega"
+)
+
+func createBinding(g *GomegaWithT, configStore *MockConfigStore, bindId string) {
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), bindId, adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+}
+
+func TestReconcilerRemovesOrphans(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	createBinding(g, configStore, "alive-id")
+	createBinding(g, configStore, "orphan-id")
+	configStore.DeleteBindingRecord("orphan-id")
+	reconciler := NewReconciler(configStore, time.Minute, false)
+
+	orphans, err := reconciler.Reconcile()
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(orphans).To(HaveLen(1))
+	g.Expect(orphans[0].BindingId).To(Equal("orphan-id"))
+	g.Expect(orphans[0].Services).To(Equal([]string{"svc-0-orphan-id"}))
+	g.Expect(orphans[0].IstioConfigs).To(HaveLen(6))
+	g.Expect(configStore.DeletedServices).To(Equal([]string{"svc-0-orphan-id"}))
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(6))
+}
+
+func TestReconcilerDryRun(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	createBinding(g, configStore, "orphan-id")
+	configStore.DeleteBindingRecord("orphan-id")
+	reconciler := NewReconciler(configStore, time.Minute, true)
+
+	orphans, err := reconciler.Reconcile()
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(orphans).To(HaveLen(1))
+	g.Expect(configStore.DeletedServices).To(BeEmpty())
+	g.Expect(configStore.DeletedIstioConfigs).To(BeEmpty())
+}
+
+func TestReconcilerUsesBindingSource(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	createBinding(g, configStore, "bind-id")
+	reconciler := NewReconciler(configStore, time.Minute, false)
+	reconciler.Bindings = staticBindingSource{}
+
+	orphans, err := reconciler.Reconcile()
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(orphans).To(HaveLen(1))
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+}
+
+func TestReconcilerReportsDeleteFailures(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	createBinding(g, configStore, "orphan-id")
+	configStore.DeleteBindingRecord("orphan-id")
+	configStore.DeleteServiceErr = errors.New("forbidden")
+	reconciler := NewReconciler(configStore, time.Minute, false)
+
+	_, err := reconciler.Reconcile()
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("svc-0-orphan-id"))
+}
+
+func TestReconcilerStartRunsPeriodically(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	createBinding(g, configStore, "orphan-id")
+	configStore.DeleteBindingRecord("orphan-id")
+	reconciler := NewReconciler(configStore, 10*time.Millisecond, false)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	reconciler.Start(stop)
+
+	g.Eventually(func() int {
+		services, _ := configStore.ListServices(ManagedSelector())
+		return len(services)
+	}).Should(Equal(0))
+}
+
+type staticBindingSource map[string]bool
+
+func (s staticBindingSource) BindingIds() (map[string]bool, error) {
+	return s, nil
+}
+
+func TestReconcilerReportsFullBindingIdOfOrphansWithHashedLabel(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	createBinding(g, configStore, "Orphan/ID")
+	configStore.DeleteBindingRecord("Orphan/ID")
+	reconciler := NewReconciler(configStore, time.Minute, true)
+
+	orphans, err := reconciler.Reconcile()
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(orphans).To(HaveLen(1))
+	g.Expect(orphans[0].BindingId).To(Equal("Orphan/ID"))
+	g.Expect(orphans[0].Services).To(Equal([]string{serviceName(0, "Orphan/ID")}))
+}
+
+func TestReconcilerRemovesObjectsAndRecordsPendingCleanup(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	createBinding(g, configStore, "bind-id")
+	interceptor := ConsumerInterceptor{ConfigStore: configStore}
+	configStore.DeleteServiceErr = errors.New("forbidden")
+	g.Expect(interceptor.PostDelete("bind-id")).NotTo(Succeed())
+	configStore.DeleteServiceErr = nil
+	reconciler := NewReconciler(configStore, time.Minute, false)
+
+	orphans, err := reconciler.Reconcile()
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(orphans).To(HaveLen(1))
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+	g.Expect(configStore.BindingRecords).To(BeEmpty())
+}
+
+// bindingDuringReconcile creates a binding right after the reconciler read the alive bindings
+type bindingDuringReconcile struct {
+	recordBindingSource
+	create func()
+}
+
+func (s bindingDuringReconcile) BindingIds() (map[string]bool, error) {
+	ids, err := s.recordBindingSource.BindingIds()
+	s.create()
+	return ids, err
+}
+
+func TestReconcilerKeepsObjectsOfBindInProgress(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	reconciler := NewReconciler(configStore, time.Minute, false)
+	reconciler.Bindings = bindingDuringReconcile{recordBindingSource{configStore}, func() { createBinding(g, configStore, "bind-id") }}
+
+	orphans, err := reconciler.Reconcile()
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(orphans).To(BeEmpty())
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.CreatedIstioConfigs).To(HaveLen(6))
+}
+
+func TestReconcilerRemovesRecordsOfAbandonedAsyncBinds(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	g.Expect(interceptor.PostBindAccepted(model.BindRequest{}, "abandoned-id")).To(Succeed())
+	g.Expect(interceptor.PostBindAccepted(model.BindRequest{}, "accepted-id")).To(Succeed())
+	abandoned := configStore.BindingRecords["abandoned-id"]
+	abandoned.Created = time.Now().Add(-2 * time.Hour)
+	configStore.BindingRecords["abandoned-id"] = abandoned
+	reconciler := NewReconciler(configStore, time.Minute, false)
+	reconciler.AsyncBindTimeout = time.Hour
+	reconciler.Lock = newLocalBindingLock(time.Second)
+
+	_, err := reconciler.Reconcile()
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.BindingRecords).To(HaveKey("accepted-id"))
+	g.Expect(configStore.BindingRecords).NotTo(HaveKey("abandoned-id"))
+}
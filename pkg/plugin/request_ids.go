@@ -0,0 +1,47 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"github.com/Peripli/service-manager/pkg/web"
+)
+
+// brokerIdPathParam is the path parameter of the broker id in the OSB route of the Service Manager proxy. The rest of
+// the route is a wildcard, so the instance and binding ids are taken from the path.
+const brokerIdPathParam = "brokerID"
+
+// RequestIds identify the broker, service instance and binding of an OSB request. Ids that are not part of the
+// request are empty.
+type RequestIds struct {
+	BrokerId   string
+	InstanceId string
+	BindingId  string
+}
+
+// requestIdsOf takes the broker id from the path parameters of the route, if set, and all other ids from the path
+// of the request
+func requestIdsOf(request *web.Request) RequestIds {
+	brokerId := request.PathParams[brokerIdPathParam]
+	if brokerId == "" {
+		brokerId = pathSegmentAfter(request.URL.Path, "osb")
+	}
+	return RequestIds{
+		BrokerId:   brokerId,
+		InstanceId: pathSegmentAfter(request.URL.Path, "service_instances"),
+		BindingId:  pathSegmentAfter(request.URL.Path, "service_bindings"),
+	}
+}
+
+// extractBindId returns the binding id of the request or a bad request error if the request has none
+func extractBindId(request *web.Request) (string, error) {
+	bindId := requestIdsOf(request).BindingId
+	if bindId == "" {
+		return "", &model.HttpError{
+			ErrorMsg:    "BadRequest",
+			Description: fmt.Sprintf("Can't extract binding id from path %s", request.URL.Path),
+			StatusCode:  http.StatusBadRequest}
+	}
+	return bindId, nil
+}
@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"github.com/Peripli/service-manager/pkg/web"
+	. "github.com/onsi/gomega"
+)
+
+func TestRequestIdsFromPath(t *testing.T) {
+	g := NewGomegaWithT(t)
+	request := &web.Request{Request: httptest.NewRequest(http.MethodPut, bindingPath, nil)}
+
+	g.Expect(requestIdsOf(request)).To(Equal(RequestIds{BrokerId: "broker-id", InstanceId: "instance-id", BindingId: "bind-id"}))
+}
+
+func TestRequestIdsFromBrokerPathParam(t *testing.T) {
+	g := NewGomegaWithT(t)
+	request := &web.Request{
+		Request:    httptest.NewRequest(http.MethodPut, "/v1/osb/broker-id/v2/service_instances/instance-id/service_bindings/bind-id", nil),
+		PathParams: map[string]string{"brokerID": "param-broker", "path": "v2/service_instances/instance-id/service_bindings/bind-id"}}
+
+	g.Expect(requestIdsOf(request)).To(Equal(RequestIds{BrokerId: "param-broker", InstanceId: "instance-id", BindingId: "bind-id"}))
+}
+
+func TestRequestIdsOfPoll(t *testing.T) {
+	g := NewGomegaWithT(t)
+	request := &web.Request{Request: httptest.NewRequest(http.MethodGet, bindingPath+"/last_operation", nil)}
+
+	g.Expect(requestIdsOf(request).BindingId).To(Equal("bind-id"))
+}
+
+func TestRequestIdsOfCatalog(t *testing.T) {
+	g := NewGomegaWithT(t)
+	request := &web.Request{Request: httptest.NewRequest(http.MethodGet, "/v1/osb/broker-id/v2/catalog", nil)}
+
+	g.Expect(requestIdsOf(request)).To(Equal(RequestIds{BrokerId: "broker-id"}))
+}
+
+func TestExtractBindIdWithoutBinding(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, path := range []string{"/v2/service_instances/instance-id", "/v2/service_instances/instance-id/service_bindings", "/v2/service_instances/instance-id/service_bindings/"} {
+		_, err := extractBindId(&web.Request{Request: httptest.NewRequest(http.MethodPut, path, nil)})
+
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.(*model.HttpError).StatusCode).To(Equal(http.StatusBadRequest))
+		g.Expect(err.(*model.HttpError).Description).To(ContainSubstring(path))
+	}
+}
+
+func TestIstioPluginRejectsRequestWithoutBindingId(t *testing.T) {
+	g := NewGomegaWithT(t)
+	plugin := IstioPlugin{interceptor: &SpyPostBindInterceptor{}}
+	nextHandler := SpyWebHandler{}
+	origURL, _ := url.Parse("http://host:80/v1/osb/broker-id/v2/service_instances/instance-id/service_bindings/")
+
+	for _, handle := range []func(*web.Request, web.Handler) (*web.Response, error){plugin.Bind, plugin.Unbind, plugin.FetchBinding, plugin.PollBinding} {
+		request := web.Request{Request: &http.Request{URL: origURL, Method: http.MethodPut}, Body: []byte("{}")}
+
+		response, err := handle(&request, &nextHandler)
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+		g.Expect(response.Body).To(MatchJSON(`{"error": "BadRequest", "description": "Can't extract binding id from path /v1/osb/broker-id/v2/service_instances/instance-id/service_bindings/"}`))
+	}
+	g.Expect(nextHandler.url.Path).To(BeEmpty())
+}
+
+func TestIstioPluginPassesRequestIdsToInterceptor(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	plugin := IstioPlugin{interceptor: ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}}
+	request := &web.Request{
+		Request:    httptest.NewRequest(http.MethodPut, "/v1/osb/broker-id/v2/service_instances/instance-id/service_bindings/bind-id", nil),
+		PathParams: map[string]string{"brokerID": "param-broker"}}
+
+	interceptor := plugin.interceptorFor(request).(ConsumerInterceptor)
+
+	g.Expect(interceptor.scope.InstanceId).To(Equal("instance-id"))
+	g.Expect(interceptor.brokerId).To(Equal("param-broker"))
+}
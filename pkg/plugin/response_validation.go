@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// validateBindResponse checks the endpoints and network data of a bind response before any object is created for
+// them. The endpoints of the network data are the hosts the egress gateway connects to and have to be host names,
+// the provider id is the subject name of their certificates.
+func validateBindResponse(response model.BindResponse) error {
+	if len(response.NetworkData.Data.Endpoints) != len(response.Endpoints) {
+		return invalidResponseError("endpoints", fmt.Sprintf(
+			"number of endpoints in NetworkData.Data (%d) doesn't match number of endpoints in root (%d)",
+			len(response.NetworkData.Data.Endpoints), len(response.Endpoints)))
+	}
+	if len(response.NetworkData.Data.Endpoints) != 0 && strings.TrimSpace(response.NetworkData.Data.ProviderId) == "" {
+		return invalidResponseError("network_data.data.provider_id", "must not be empty")
+	}
+	for index, endpoint := range response.Endpoints {
+		field := fmt.Sprintf("endpoints[%d]", index)
+		if endpoint.Host == "" {
+			return invalidResponseError(field+".host", "must not be empty")
+		}
+		if err := validatePort(endpoint.Port); err != nil {
+			return invalidResponseError(field+".port", err.Error())
+		}
+	}
+	for index, endpoint := range response.NetworkData.Data.Endpoints {
+		field := fmt.Sprintf("network_data.data.endpoints[%d]", index)
+		if err := validateProviderHost(endpoint.Host); err != nil {
+			return invalidResponseError(field+".host", err.Error())
+		}
+		if err := validatePort(endpoint.Port); err != nil {
+			return invalidResponseError(field+".port", err.Error())
+		}
+	}
+	return nil
+}
+
+func validateProviderHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	if net.ParseIP(host) != nil {
+		return fmt.Errorf("%s is an IP address, the egress gateway requires a host name", host)
+	}
+	if errs := validation.IsDNS1123Subdomain(strings.ToLower(host)); len(errs) != 0 {
+		return fmt.Errorf("%s is not a valid host name: %s", host, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func validatePort(port int) error {
+	if errs := validation.IsValidPortNum(port); len(errs) != 0 {
+		return fmt.Errorf("%d is not a valid port: %s", port, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func invalidResponseError(field string, reason string) error {
+	return &model.HttpError{
+		ErrorMsg:    "BadGateway",
+		Description: fmt.Sprintf("Invalid bind response of the broker, %s: %s", field, reason),
+		StatusCode:  http.StatusBadGateway}
+}
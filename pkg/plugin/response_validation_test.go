@@ -0,0 +1,85 @@
+package plugin
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	. "github.com/onsi/gomega"
+)
+
+func TestValidateBindResponseAcceptsValidResponses(t *testing.T) {
+	g := NewGomegaWithT(t)
+	response := bindResponseWithEndpoints(providerEndpoint)
+	response.Endpoints = []model.Endpoint{{Host: "10.11.12.13", Port: 5432}}
+
+	g.Expect(validateBindResponse(response)).To(Succeed())
+	g.Expect(validateBindResponse(model.BindResponse{})).To(Succeed())
+}
+
+func TestConsumerInterceptorPostBindRejectsInvalidResponses(t *testing.T) {
+	withEndpoint := func(field string, endpoint model.Endpoint) func(*model.BindResponse) {
+		return func(response *model.BindResponse) {
+			if field == "endpoints" {
+				response.Endpoints = []model.Endpoint{endpoint}
+			} else {
+				response.NetworkData.Data.Endpoints = []model.Endpoint{endpoint}
+			}
+		}
+	}
+	for _, testCase := range []struct {
+		field  string
+		modify func(*model.BindResponse)
+	}{
+		{"endpoints", func(response *model.BindResponse) { response.Endpoints = nil }},
+		{"network_data.data.provider_id", func(response *model.BindResponse) { response.NetworkData.Data.ProviderId = "" }},
+		{"endpoints[0].host", withEndpoint("endpoints", model.Endpoint{Port: 5432})},
+		{"endpoints[0].port", withEndpoint("endpoints", model.Endpoint{Host: "postgres.example.com"})},
+		{"endpoints[0].port", withEndpoint("endpoints", model.Endpoint{Host: "postgres.example.com", Port: 70000})},
+		{"network_data.data.endpoints[0].host", withEndpoint("network_data", model.Endpoint{Port: 5432})},
+		{"network_data.data.endpoints[0].host", withEndpoint("network_data", model.Endpoint{Host: "10.11.12.13", Port: 5432})},
+		{"network_data.data.endpoints[0].host", withEndpoint("network_data", model.Endpoint{Host: "::1", Port: 5432})},
+		{"network_data.data.endpoints[0].host", withEndpoint("network_data", model.Endpoint{Host: "postgres example", Port: 5432})},
+		{"network_data.data.endpoints[0].port", withEndpoint("network_data", model.Endpoint{Host: "postgres.example.com"})},
+		{"network_data.data.endpoints[0].port", withEndpoint("network_data", model.Endpoint{Host: "postgres.example.com", Port: -1})},
+	} {
+		t.Run(testCase.field, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+			interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+			response := bindResponseWithEndpoints(providerEndpoint)
+			testCase.modify(&response)
+
+			_, err := interceptor.PostBind(model.BindRequest{}, response, "bind-id", adaptEndpoints)
+
+			g.Expect(err).To(HaveOccurred())
+			httpError, ok := err.(*model.HttpError)
+			g.Expect(ok).To(BeTrue())
+			g.Expect(httpError.StatusCode).To(Equal(http.StatusBadGateway))
+			g.Expect(httpError.Description).To(ContainSubstring(testCase.field + ":"))
+			g.Expect(configStore.BindingRecords).To(BeEmpty())
+			g.Expect(configStore.CreatedServices).To(BeEmpty())
+			g.Expect(configStore.CreatedIstioConfigs).To(BeEmpty())
+		})
+	}
+}
+
+func TestConsumerInterceptorPostFetchBindingToleratesInvalidResponses(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public"}
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	legacy := bindResponseWithEndpoints(model.Endpoint{Host: "10.11.12.13", Port: 5432})
+
+	binding, err := interceptor.PostFetchBinding(legacy, "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 5555}}))
+
+	legacy.Endpoints = nil
+	_, err = interceptor.PostFetchBinding(legacy, "bind-id", adaptEndpoints)
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(*model.HttpError).StatusCode).To(Equal(http.StatusBadGateway))
+}
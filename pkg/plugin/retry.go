@@ -0,0 +1,246 @@
+package plugin
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	istioModel "istio.io/istio/pilot/pkg/model"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+)
+
+const (
+	retryMultiplier = 2
+	// retryJitter is the fraction by which each delay is randomly shortened or lengthened
+	retryJitter = 0.5
+)
+
+// RetryPolicy retries operations that failed with a transient error, with exponentially growing delays.
+// All attempts have to finish within the timeout and the deadline of the request, if any.
+type RetryPolicy struct {
+	MaxAttempts     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Timeout         time.Duration
+	// clock measures the timeout and waits between the attempts, the system clock is used if it is nil
+	clock retryClock
+}
+
+// retryClock is the time source of the retries
+type retryClock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(delay time.Duration) <-chan time.Time {
+	return time.After(delay)
+}
+
+// DefaultRetryPolicy returns the retry policy used for all values that are not configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:     5,
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     2 * time.Second,
+		Timeout:         10 * time.Second,
+	}
+}
+
+// isTransientError returns true for errors that may not occur again when the operation is retried,
+// e.g. throttling, timeouts and unavailability of the API server
+func isTransientError(err error) bool {
+	if errors.IsTooManyRequests(err) || errors.IsServerTimeout(err) || errors.IsTimeout(err) ||
+		errors.IsServiceUnavailable(err) || errors.IsInternalError(err) || errors.IsConflict(err) ||
+		errors.IsUnexpectedServerError(err) {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err)
+}
+
+// delay returns the delay before the given retry, starting with 1, with jitter applied
+func (p RetryPolicy) delay(retry int) time.Duration {
+	delay := float64(p.InitialInterval)
+	for i := 1; i < retry && delay < float64(p.MaxInterval); i++ {
+		delay *= retryMultiplier
+	}
+	if delay > float64(p.MaxInterval) {
+		delay = float64(p.MaxInterval)
+	}
+	return time.Duration(delay * (1 + retryJitter*(2*rand.Float64()-1)))
+}
+
+// do calls the operation until it succeeds, fails with an error that is not transient, or no attempt is left
+// before the deadline. The error of the last attempt is returned.
+func (p RetryPolicy) do(ctx context.Context, operation string, call func() error) error {
+	return p.doWhile(ctx, operation, isTransientError, call)
+}
+
+// doWhile calls the operation like do, but retries the errors for which retryable returns true
+func (p RetryPolicy) doWhile(ctx context.Context, operation string, retryable func(error) bool, call func() error) error {
+	clock := p.clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	deadline := clock.Now().Add(p.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || !retryable(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+		delay := p.delay(attempt)
+		if seconds, ok := errors.SuggestsClientDelay(err); ok && time.Duration(seconds)*time.Second > delay {
+			delay = time.Duration(seconds) * time.Second
+		}
+		if clock.Now().Add(delay).After(deadline) {
+			loggerFor(ctx).Warnf("Giving up %s after %d attempts, deadline exceeded: %s", operation, attempt, err.Error())
+			return err
+		}
+		loggerFor(ctx).Infof("Retrying %s in %s after attempt %d failed: %s", operation, delay, attempt, err.Error())
+		operationRetries.WithLabelValues(operation).Inc()
+		select {
+		case <-ctx.Done():
+			return err
+		case <-clock.After(delay):
+		}
+	}
+}
+
+// retryingConfigStore retries the operations of the wrapped store according to the policy.
+// Retried creations may find the object created by an attempt whose response was lost, so callers
+// have to tolerate objects that already exist.
+type retryingConfigStore struct {
+	ConfigStore
+	policy RetryPolicy
+	ctx    context.Context
+}
+
+func newRetryingConfigStore(configStore ConfigStore, policy RetryPolicy) retryingConfigStore {
+	return retryingConfigStore{ConfigStore: configStore, policy: policy, ctx: context.Background()}
+}
+
+// forContext returns a store that stops retrying at the deadline or cancellation of the context
+func (s retryingConfigStore) forContext(ctx context.Context) retryingConfigStore {
+	s.ctx = ctx
+	return s
+}
+
+func (s retryingConfigStore) InNamespace(namespace string) ConfigStore {
+	s.ConfigStore = s.ConfigStore.InNamespace(namespace)
+	return s
+}
+
+func (s retryingConfigStore) CreateService(service *v1.Service) (*v1.Service, error) {
+	var result *v1.Service
+	err := s.policy.do(s.ctx, "create service", func() error {
+		var err error
+		result, err = s.ConfigStore.CreateService(service)
+		return err
+	})
+	return result, err
+}
+
+func (s retryingConfigStore) GetService(serviceName string) (*v1.Service, error) {
+	var result *v1.Service
+	err := s.policy.do(s.ctx, "get service", func() error {
+		var err error
+		result, err = s.ConfigStore.GetService(serviceName)
+		return err
+	})
+	return result, err
+}
+
+func (s retryingConfigStore) CreateIstioConfig(config istioModel.Config) error {
+	return s.policy.do(s.ctx, "create "+config.Type, func() error {
+		return s.ConfigStore.CreateIstioConfig(config)
+	})
+}
+
+func (s retryingConfigStore) GetIstioConfig(configType string, configName string) (*istioModel.Config, error) {
+	var result *istioModel.Config
+	err := s.policy.do(s.ctx, "get "+configType, func() error {
+		var err error
+		result, err = s.ConfigStore.GetIstioConfig(configType, configName)
+		return err
+	})
+	return result, err
+}
+
+func (s retryingConfigStore) DeleteService(serviceName string) error {
+	return s.policy.do(s.ctx, "delete service", func() error {
+		return s.ConfigStore.DeleteService(serviceName)
+	})
+}
+
+func (s retryingConfigStore) DeleteIstioConfig(configType string, configName string) error {
+	return s.policy.do(s.ctx, "delete "+configType, func() error {
+		return s.ConfigStore.DeleteIstioConfig(configType, configName)
+	})
+}
+
+func (s retryingConfigStore) ListServices(selector labels.Selector) ([]v1.Service, error) {
+	var result []v1.Service
+	err := s.policy.do(s.ctx, "list services", func() error {
+		var err error
+		result, err = s.ConfigStore.ListServices(selector)
+		return err
+	})
+	return result, err
+}
+
+func (s retryingConfigStore) ListIstioConfigs(configType string, selector labels.Selector) ([]istioModel.Config, error) {
+	var result []istioModel.Config
+	err := s.policy.do(s.ctx, "list "+configType, func() error {
+		var err error
+		result, err = s.ConfigStore.ListIstioConfigs(configType, selector)
+		return err
+	})
+	return result, err
+}
+
+func (s retryingConfigStore) SaveBindingRecord(record BindingRecord) error {
+	return s.policy.do(s.ctx, "save binding record", func() error {
+		return s.ConfigStore.SaveBindingRecord(record)
+	})
+}
+
+func (s retryingConfigStore) GetBindingRecord(bindId string) (*BindingRecord, error) {
+	var result *BindingRecord
+	err := s.policy.do(s.ctx, "get binding record", func() error {
+		var err error
+		result, err = s.ConfigStore.GetBindingRecord(bindId)
+		return err
+	})
+	return result, err
+}
+
+func (s retryingConfigStore) ListBindingRecords() ([]BindingRecord, error) {
+	var result []BindingRecord
+	err := s.policy.do(s.ctx, "list binding records", func() error {
+		var err error
+		result, err = s.ConfigStore.ListBindingRecords()
+		return err
+	})
+	return result, err
+}
+
+func (s retryingConfigStore) DeleteBindingRecord(bindId string) error {
+	return s.policy.do(s.ctx, "delete binding record", func() error {
+		return s.ConfigStore.DeleteBindingRecord(bindId)
+	})
+}
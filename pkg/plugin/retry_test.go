@@ -0,0 +1,263 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	. "github.com/onsi/gomega"
+	istioModel "istio.io/istio/pilot/pkg/model"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var testRetryPolicy = RetryPolicy{MaxAttempts: 4, InitialInterval: time.Millisecond, MaxInterval: 5 * time.Millisecond, Timeout: time.Second}
+
+// fault is returned by the next call of an operation of the faultyConfigStore. An applied fault
+// simulates a lost response, i.e. the operation took effect but the caller sees an error.
+type fault struct {
+	err     error
+	applied bool
+}
+
+// faultyConfigStore injects faults into the operations of the wrapped store
+type faultyConfigStore struct {
+	*MockConfigStore
+	faults map[string][]fault
+	calls  map[string]int
+	mutex  sync.Mutex
+}
+
+func newFaultyConfigStore(configStore *MockConfigStore) *faultyConfigStore {
+	return &faultyConfigStore{MockConfigStore: configStore, faults: make(map[string][]fault), calls: make(map[string]int)}
+}
+
+func (s *faultyConfigStore) inject(operation string, faults ...fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults[operation] = append(s.faults[operation], faults...)
+}
+
+func (s *faultyConfigStore) callCount(operation string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls[operation]
+}
+
+func (s *faultyConfigStore) call(operation string, delegate func() error) error {
+	s.mutex.Lock()
+	s.calls[operation]++
+	var next *fault
+	if faults := s.faults[operation]; len(faults) > 0 {
+		next = &faults[0]
+		s.faults[operation] = faults[1:]
+	}
+	s.mutex.Unlock()
+	if next == nil {
+		return delegate()
+	}
+	if next.applied {
+		delegate()
+	}
+	return next.err
+}
+
+func (s *faultyConfigStore) CreateService(service *v1.Service) (*v1.Service, error) {
+	var result *v1.Service
+	err := s.call("CreateService", func() error {
+		var err error
+		result, err = s.MockConfigStore.CreateService(service)
+		return err
+	})
+	return result, err
+}
+
+func (s *faultyConfigStore) CreateIstioConfig(config istioModel.Config) error {
+	return s.call("CreateIstioConfig", func() error {
+		return s.MockConfigStore.CreateIstioConfig(config)
+	})
+}
+
+func (s *faultyConfigStore) SaveBindingRecord(record BindingRecord) error {
+	return s.call("SaveBindingRecord", func() error {
+		return s.MockConfigStore.SaveBindingRecord(record)
+	})
+}
+
+var (
+	servicesResource = schema.GroupResource{Resource: "services"}
+	throttled        = fault{err: errors.NewTooManyRequests("throttled", 0)}
+	timedOut         = fault{err: errors.NewServerTimeout(servicesResource, "create", 0)}
+	forbidden        = fault{err: errors.NewForbidden(servicesResource, "svc-0-bind-id", fmt.Errorf("denied"))}
+)
+
+func TestIsTransientError(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(isTransientError(errors.NewTooManyRequests("throttled", 1))).To(BeTrue())
+	g.Expect(isTransientError(errors.NewServerTimeout(servicesResource, "create", 1))).To(BeTrue())
+	g.Expect(isTransientError(errors.NewTimeoutError("timeout", 1))).To(BeTrue())
+	g.Expect(isTransientError(errors.NewServiceUnavailable("leader election"))).To(BeTrue())
+	g.Expect(isTransientError(errors.NewInternalError(fmt.Errorf("etcd")))).To(BeTrue())
+	g.Expect(isTransientError(errors.NewConflict(servicesResource, "svc", fmt.Errorf("modified")))).To(BeTrue())
+	g.Expect(isTransientError(&url.Error{Op: "Post", URL: "https://kubernetes", Err: io.EOF})).To(BeTrue())
+
+	g.Expect(isTransientError(errors.NewAlreadyExists(servicesResource, "svc"))).To(BeFalse())
+	g.Expect(isTransientError(errors.NewNotFound(servicesResource, "svc"))).To(BeFalse())
+	g.Expect(isTransientError(errors.NewForbidden(servicesResource, "svc", fmt.Errorf("denied")))).To(BeFalse())
+	g.Expect(isTransientError(errors.NewBadRequest("invalid"))).To(BeFalse())
+	g.Expect(isTransientError(fmt.Errorf("unknown"))).To(BeFalse())
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	g := NewGomegaWithT(t)
+	policy := RetryPolicy{InitialInterval: 100 * time.Millisecond, MaxInterval: time.Second}
+
+	for i := 0; i < 100; i++ {
+		g.Expect(policy.delay(1)).To(BeNumerically("~", 100*time.Millisecond, 50*time.Millisecond))
+		g.Expect(policy.delay(3)).To(BeNumerically("~", 400*time.Millisecond, 200*time.Millisecond))
+		g.Expect(policy.delay(10)).To(BeNumerically("~", time.Second, 500*time.Millisecond))
+	}
+}
+
+func TestRetryingConfigStoreRetriesTransientErrors(t *testing.T) {
+	g := NewGomegaWithT(t)
+	faultyStore := newFaultyConfigStore(&MockConfigStore{ClusterIp: "10.0.0.1"})
+	faultyStore.inject("CreateService", throttled, timedOut)
+	configStore := newRetryingConfigStore(faultyStore, testRetryPolicy)
+
+	metadata := BindingMetadata{BindingId: "bind-id"}
+	service := &v1.Service{}
+	service.Name = "svc-0-bind-id"
+	service.Labels = metadata.Labels()
+	service.Annotations = metadata.Annotations()
+
+	service, err := configStore.CreateService(service)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(service.Spec.ClusterIP).To(Equal("10.0.0.1"))
+	g.Expect(faultyStore.callCount("CreateService")).To(Equal(3))
+}
+
+func TestRetryingConfigStoreDoesNotRetryOtherErrors(t *testing.T) {
+	g := NewGomegaWithT(t)
+	faultyStore := newFaultyConfigStore(&MockConfigStore{})
+	faultyStore.inject("CreateService", forbidden)
+	configStore := newRetryingConfigStore(faultyStore, testRetryPolicy)
+
+	_, err := configStore.CreateService(&v1.Service{})
+
+	g.Expect(errors.IsForbidden(err)).To(BeTrue())
+	g.Expect(faultyStore.callCount("CreateService")).To(Equal(1))
+}
+
+func TestRetryingConfigStoreStopsAfterMaxAttempts(t *testing.T) {
+	g := NewGomegaWithT(t)
+	faultyStore := newFaultyConfigStore(&MockConfigStore{})
+	faultyStore.inject("CreateIstioConfig", throttled, throttled, throttled, throttled, throttled)
+	configStore := newRetryingConfigStore(faultyStore, testRetryPolicy)
+
+	err := configStore.CreateIstioConfig(istioModel.Config{})
+
+	g.Expect(errors.IsTooManyRequests(err)).To(BeTrue())
+	g.Expect(faultyStore.callCount("CreateIstioConfig")).To(Equal(testRetryPolicy.MaxAttempts))
+}
+
+func TestRetryingConfigStoreStopsAtDeadlineOfRequest(t *testing.T) {
+	g := NewGomegaWithT(t)
+	faultyStore := newFaultyConfigStore(&MockConfigStore{})
+	faultyStore.inject("SaveBindingRecord", throttled, throttled)
+	policy := RetryPolicy{MaxAttempts: 3, InitialInterval: time.Second, MaxInterval: time.Second, Timeout: time.Minute}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	configStore := newRetryingConfigStore(faultyStore, policy).forContext(ctx)
+
+	start := time.Now()
+	err := configStore.SaveBindingRecord(BindingRecord{BindingId: "bind-id"})
+
+	g.Expect(errors.IsTooManyRequests(err)).To(BeTrue())
+	g.Expect(faultyStore.callCount("SaveBindingRecord")).To(Equal(1))
+	g.Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+}
+
+// fakeClock advances its time by the delays waited for instead of waiting
+type fakeClock struct {
+	now    time.Time
+	waited time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now.Add(c.waited)
+}
+
+func (c *fakeClock) After(delay time.Duration) <-chan time.Time {
+	c.waited += delay
+	after := make(chan time.Time, 1)
+	after <- c.Now()
+	return after
+}
+
+func TestRetryingConfigStoreStopsAtTimeout(t *testing.T) {
+	g := NewGomegaWithT(t)
+	faultyStore := newFaultyConfigStore(&MockConfigStore{})
+	faultyStore.inject("SaveBindingRecord", throttled, throttled, throttled, throttled, throttled, throttled, throttled, throttled, throttled)
+	clock := &fakeClock{now: time.Now()}
+	policy := RetryPolicy{MaxAttempts: 10, InitialInterval: 20 * time.Millisecond, MaxInterval: 20 * time.Millisecond, Timeout: 50 * time.Millisecond,
+		clock: clock}
+	configStore := newRetryingConfigStore(faultyStore, policy)
+
+	err := configStore.SaveBindingRecord(BindingRecord{BindingId: "bind-id"})
+
+	// each delay is between 10ms and 30ms, so the timeout ends the retries after 2 to 6 attempts
+	g.Expect(errors.IsTooManyRequests(err)).To(BeTrue())
+	g.Expect(faultyStore.callCount("SaveBindingRecord")).To(BeNumerically(">=", 2))
+	g.Expect(faultyStore.callCount("SaveBindingRecord")).To(BeNumerically("<=", 6))
+	g.Expect(clock.waited).To(BeNumerically("<=", policy.Timeout))
+}
+
+func TestRetryingConfigStoreInNamespaceKeepsRetrying(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := newRetryingConfigStore(&MockConfigStore{}, testRetryPolicy)
+
+	namespaced := configStore.InNamespace("egress")
+
+	g.Expect(namespaced).To(BeAssignableToTypeOf(retryingConfigStore{}))
+	g.Expect(namespaced.Namespace()).To(Equal("egress"))
+}
+
+func TestConsumerInterceptorPostBindRetriesTransientErrors(t *testing.T) {
+	g := NewGomegaWithT(t)
+	faultyStore := newFaultyConfigStore(&MockConfigStore{ClusterIp: "10.0.0.1"})
+	faultyStore.inject("CreateIstioConfig", throttled, timedOut)
+	faultyStore.inject("SaveBindingRecord", throttled)
+	interceptor := ConsumerInterceptor{ConfigStore: newRetryingConfigStore(faultyStore, testRetryPolicy), NetworkProfile: "urn:local.test:public"}
+
+	binding, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 5555}}))
+	g.Expect(faultyStore.CreatedIstioConfigs).To(HaveLen(6))
+	g.Expect(faultyStore.DeletedServices).To(BeEmpty())
+	g.Expect(faultyStore.DeletedIstioConfigs).To(BeEmpty())
+}
+
+func TestConsumerInterceptorPostBindToleratesLostResponses(t *testing.T) {
+	g := NewGomegaWithT(t)
+	faultyStore := newFaultyConfigStore(&MockConfigStore{ClusterIp: "10.0.0.1"})
+	faultyStore.inject("CreateService", fault{err: timedOut.err, applied: true})
+	faultyStore.inject("CreateIstioConfig", fault{err: timedOut.err, applied: true})
+	interceptor := ConsumerInterceptor{ConfigStore: newRetryingConfigStore(faultyStore, testRetryPolicy), NetworkProfile: "urn:local.test:public"}
+
+	binding, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 5555}}))
+	g.Expect(faultyStore.CreatedServices).To(HaveLen(1))
+	g.Expect(faultyStore.CreatedIstioConfigs).To(HaveLen(6))
+}
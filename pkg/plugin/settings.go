@@ -0,0 +1,315 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// DefaultConfigFile is where a ConfigMap with the plugin configuration is expected to be mounted
+	DefaultConfigFile = "/etc/istio-plugin/config.yml"
+	configFileKey     = "config_file"
+	flagPrefix        = "istio."
+)
+
+// Settings of the plugin. They are read from a YAML file, e.g. a mounted ConfigMap, from ISTIO_* environment
+// variables and from --istio.* flags. Flags take precedence over environment variables, which take precedence
+// over the file.
+type Settings struct {
+	ServiceNamePrefix string `mapstructure:"service_name_prefix"`
+	ConsumerId        string `mapstructure:"consumer_id"`
+	NetworkProfile    string `mapstructure:"network_profile"`
+	Namespace         string `mapstructure:"namespace"`
+	// TargetNamespace of the services and istio configs, if not the namespace of the plugin
+	TargetNamespace string `mapstructure:"target_namespace"`
+	// TargetNamespaceTemplate derives the target namespace per binding, see NewNamespaceTemplate
+	TargetNamespaceTemplate string        `mapstructure:"target_namespace_template"`
+	LogLevel                string        `mapstructure:"log_level"`
+	ReconcileInterval       time.Duration `mapstructure:"reconcile_interval"`
+	ReconcileDryRun         bool          `mapstructure:"reconcile_dry_run"`
+	// AsyncBindTimeout is the time after which the reconciler removes the record of an asynchronous bind that did not succeed
+	AsyncBindTimeout time.Duration `mapstructure:"async_bind_timeout"`
+	// Retry* configure the retries of kubernetes operations that failed with a transient error, see RetryPolicy
+	RetryMaxAttempts     int           `mapstructure:"retry_max_attempts"`
+	RetryInitialInterval time.Duration `mapstructure:"retry_initial_interval"`
+	RetryMaxInterval     time.Duration `mapstructure:"retry_max_interval"`
+	RetryTimeout         time.Duration `mapstructure:"retry_timeout"`
+	// LockTimeout is the time an operation waits for another operation on the same binding to finish
+	LockTimeout time.Duration `mapstructure:"lock_timeout"`
+	// LockLease also locks bindings across replicas with a lease, which is renewed while the binding is locked and
+	// expires after LockLeaseDuration otherwise
+	LockLease         bool          `mapstructure:"lock_lease"`
+	LockLeaseDuration time.Duration `mapstructure:"lock_lease_duration"`
+	// CreateParallelism is the maximum number of objects of a binding that are created at the same time
+	CreateParallelism int `mapstructure:"create_parallelism"`
+	// OrphanMitigation unbinds bindings at the broker that could not be added to the service mesh
+	OrphanMitigation bool `mapstructure:"orphan_mitigation"`
+	// ServicePort, EgressPort and EgressGateway* describe the service mesh, see MeshTopology
+	ServicePort          int  `mapstructure:"service_port"`
+	PreserveProviderPort bool `mapstructure:"preserve_provider_port"`
+	// ServiceFQDN maps endpoints to the fully qualified names of the local services instead of their cluster ips
+	ServiceFQDN            bool   `mapstructure:"service_fqdn"`
+	EgressPort             int    `mapstructure:"egress_port"`
+	EgressGatewayService   string `mapstructure:"egress_gateway_service"`
+	EgressGatewayNamespace string `mapstructure:"egress_gateway_namespace"`
+	// EgressGatewaySelector is a label selector of the form key=value,key=value
+	EgressGatewaySelector string `mapstructure:"egress_gateway_selector"`
+	// ClusterDomain of the consumer cluster
+	ClusterDomain string `mapstructure:"cluster_domain"`
+	// NetworkProfiles select the network profile, or disable the service mesh, per broker, service or plan.
+	// They can only be configured in the file.
+	NetworkProfiles []NetworkProfileRule `mapstructure:"network_profiles"`
+	// Brokers override the consumer identity per broker id, i.e. the path segment after /v1/osb/.
+	// They can only be configured in the file. Broker ids are matched case-insensitively.
+	Brokers map[string]BrokerSettings `mapstructure:"brokers"`
+}
+
+// BrokerSettings override the consumer identity of the plugin for the bindings of one broker.
+// Empty values are taken from the plugin settings.
+type BrokerSettings struct {
+	ServiceNamePrefix string `mapstructure:"service_name_prefix"`
+	ConsumerId        string `mapstructure:"consumer_id"`
+	NetworkProfile    string `mapstructure:"network_profile"`
+}
+
+// globalRequired returns true if the global value of a broker setting is used, i.e. no brokers are configured or
+// some broker doesn't override it
+func globalRequired(brokers map[string]BrokerSettings, override func(BrokerSettings) string) bool {
+	if len(brokers) == 0 {
+		return true
+	}
+	for _, broker := range brokers {
+		if override(broker) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultSettings returns the settings used for all values that are not configured
+func DefaultSettings() *Settings {
+	retryPolicy := DefaultRetryPolicy()
+	return &Settings{
+		ServiceNamePrefix:      "istio-",
+		ReconcileInterval:      10 * time.Minute,
+		AsyncBindTimeout:       7 * 24 * time.Hour,
+		RetryMaxAttempts:       retryPolicy.MaxAttempts,
+		RetryInitialInterval:   retryPolicy.InitialInterval,
+		RetryMaxInterval:       retryPolicy.MaxInterval,
+		RetryTimeout:           retryPolicy.Timeout,
+		LockTimeout:            20 * time.Second,
+		LockLeaseDuration:      2 * time.Minute,
+		CreateParallelism:      4,
+		OrphanMitigation:       true,
+		ServicePort:            defaultServicePort,
+		EgressPort:             defaultEgressPort,
+		EgressGatewayService:   defaultEgressGatewayService,
+		EgressGatewayNamespace: defaultEgressGatewayNamespace,
+		EgressGatewaySelector:  defaultEgressGatewaySelector,
+		ClusterDomain:          defaultClusterDomain,
+	}
+}
+
+// RetryPolicy returns the policy for retries of kubernetes operations
+func (s *Settings) RetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:     s.RetryMaxAttempts,
+		InitialInterval: s.RetryInitialInterval,
+		MaxInterval:     s.RetryMaxInterval,
+		Timeout:         s.RetryTimeout,
+	}
+}
+
+// MeshTopology returns the topology of the service mesh the generated objects route the traffic through.
+// Values that are not set are taken from DefaultMeshTopology.
+func (s *Settings) MeshTopology() MeshTopology {
+	selector, _ := labels.ConvertSelectorToLabelsMap(s.EgressGatewaySelector)
+	topology := MeshTopology{
+		ServicePort:           int32(s.ServicePort),
+		PreserveProviderPort:  s.PreserveProviderPort,
+		ServiceFQDN:           s.ServiceFQDN,
+		ClusterDomain:         s.ClusterDomain,
+		EgressPort:            s.EgressPort,
+		EgressGatewaySelector: selector,
+	}
+	if s.EgressGatewayService != "" || s.EgressGatewayNamespace != "" || s.ClusterDomain != "" {
+		topology.EgressGatewayHost = serviceHost(valueOr(s.EgressGatewayService, defaultEgressGatewayService),
+			valueOr(s.EgressGatewayNamespace, defaultEgressGatewayNamespace), valueOr(s.ClusterDomain, defaultClusterDomain))
+	}
+	return topology.withDefaults()
+}
+
+func valueOr(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// Validate returns an error describing the first invalid setting
+func (s *Settings) Validate() error {
+	if s.NetworkProfile == "" && globalRequired(s.Brokers, func(b BrokerSettings) string { return b.NetworkProfile }) {
+		return fmt.Errorf("network_profile missing")
+	}
+	if s.ConsumerId == "" && globalRequired(s.Brokers, func(b BrokerSettings) string { return b.ConsumerId }) {
+		return fmt.Errorf("consumer_id missing")
+	}
+	if s.LogLevel != "" {
+		if _, err := logrus.ParseLevel(s.LogLevel); err != nil {
+			return fmt.Errorf("log_level invalid: %s", err.Error())
+		}
+	}
+	if s.ReconcileInterval < 0 {
+		return fmt.Errorf("reconcile_interval must not be negative: %s", s.ReconcileInterval)
+	}
+	if s.AsyncBindTimeout < 0 {
+		return fmt.Errorf("async_bind_timeout must not be negative: %s", s.AsyncBindTimeout)
+	}
+	if s.TargetNamespace != "" && s.TargetNamespaceTemplate != "" {
+		return fmt.Errorf("target_namespace and target_namespace_template must not both be set")
+	}
+	if errs := validation.IsDNS1123Label(s.TargetNamespace); s.TargetNamespace != "" && len(errs) != 0 {
+		return fmt.Errorf("target_namespace invalid: %s", strings.Join(errs, ", "))
+	}
+	if _, err := NewNamespaceTemplate(s.TargetNamespaceTemplate); err != nil {
+		return fmt.Errorf("target_namespace_template invalid: %s", err.Error())
+	}
+	for index, rule := range s.NetworkProfiles {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("network_profiles[%d] invalid: %s", index, err.Error())
+		}
+	}
+	if s.RetryMaxAttempts < 1 {
+		return fmt.Errorf("retry_max_attempts must be at least 1: %d", s.RetryMaxAttempts)
+	}
+	if s.RetryInitialInterval < 0 || s.RetryMaxInterval < s.RetryInitialInterval {
+		return fmt.Errorf("retry_initial_interval must not be negative or greater than retry_max_interval: %s, %s",
+			s.RetryInitialInterval, s.RetryMaxInterval)
+	}
+	if s.RetryTimeout < 0 {
+		return fmt.Errorf("retry_timeout must not be negative: %s", s.RetryTimeout)
+	}
+	if s.LockTimeout <= 0 {
+		return fmt.Errorf("lock_timeout must be positive: %s", s.LockTimeout)
+	}
+	if s.LockLease && s.LockLeaseDuration < time.Second {
+		return fmt.Errorf("lock_lease_duration must be at least 1s: %s", s.LockLeaseDuration)
+	}
+	if s.CreateParallelism < 1 {
+		return fmt.Errorf("create_parallelism must be at least 1: %d", s.CreateParallelism)
+	}
+	if errs := validation.IsValidPortNum(s.ServicePort); s.ServicePort != 0 && len(errs) != 0 {
+		return fmt.Errorf("service_port invalid: %s", strings.Join(errs, ", "))
+	}
+	if errs := validation.IsValidPortNum(s.EgressPort); s.EgressPort != 0 && len(errs) != 0 {
+		return fmt.Errorf("egress_port invalid: %s", strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1035Label(s.EgressGatewayService); s.EgressGatewayService != "" && len(errs) != 0 {
+		return fmt.Errorf("egress_gateway_service invalid: %s", strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Label(s.EgressGatewayNamespace); s.EgressGatewayNamespace != "" && len(errs) != 0 {
+		return fmt.Errorf("egress_gateway_namespace invalid: %s", strings.Join(errs, ", "))
+	}
+	if _, err := labels.ConvertSelectorToLabelsMap(s.EgressGatewaySelector); err != nil {
+		return fmt.Errorf("egress_gateway_selector must be of the form key=value,key=value: %s", err.Error())
+	}
+	if errs := validation.IsDNS1123Subdomain(s.ClusterDomain); s.ClusterDomain != "" && len(errs) != 0 {
+		return fmt.Errorf("cluster_domain invalid: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (s *Settings) defaults() map[string]interface{} {
+	return map[string]interface{}{
+		"service_name_prefix":       s.ServiceNamePrefix,
+		"consumer_id":               s.ConsumerId,
+		"network_profile":           s.NetworkProfile,
+		"namespace":                 s.Namespace,
+		"target_namespace":          s.TargetNamespace,
+		"target_namespace_template": s.TargetNamespaceTemplate,
+		"log_level":                 s.LogLevel,
+		"reconcile_interval":        s.ReconcileInterval.String(),
+		"reconcile_dry_run":         s.ReconcileDryRun,
+		"async_bind_timeout":        s.AsyncBindTimeout.String(),
+		"retry_max_attempts":        s.RetryMaxAttempts,
+		"retry_initial_interval":    s.RetryInitialInterval.String(),
+		"retry_max_interval":        s.RetryMaxInterval.String(),
+		"retry_timeout":             s.RetryTimeout.String(),
+		"lock_timeout":              s.LockTimeout.String(),
+		"lock_lease":                s.LockLease,
+		"lock_lease_duration":       s.LockLeaseDuration.String(),
+		"create_parallelism":        s.CreateParallelism,
+		"orphan_mitigation":         s.OrphanMitigation,
+		"service_port":              s.ServicePort,
+		"preserve_provider_port":    s.PreserveProviderPort,
+		"service_fqdn":              s.ServiceFQDN,
+		"egress_port":               s.EgressPort,
+		"egress_gateway_service":    s.EgressGatewayService,
+		"egress_gateway_namespace":  s.EgressGatewayNamespace,
+		"egress_gateway_selector":   s.EgressGatewaySelector,
+		"cluster_domain":            s.ClusterDomain,
+	}
+}
+
+// LoadSettings reads the settings from the config file, the environment and the given command line arguments.
+// Arguments that are not --istio.* flags are ignored, as they belong to the service manager proxy.
+func LoadSettings(args []string) (*Settings, error) {
+	config := viper.New()
+	config.SetEnvPrefix("istio")
+	config.AutomaticEnv()
+
+	flags := pflag.NewFlagSet("istio", pflag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.SetOutput(ioutil.Discard)
+	keys := append([]string{configFileKey}, keysOf(DefaultSettings().defaults())...)
+	for _, key := range keys {
+		flags.String(flagPrefix+key, "", "")
+	}
+	err := flags.Parse(args)
+	if err != nil && err != pflag.ErrHelp {
+		return nil, fmt.Errorf("Can't parse istio plugin flags: %s", err.Error())
+	}
+	for _, key := range keys {
+		flag := flags.Lookup(flagPrefix + key)
+		if flag.Changed {
+			config.Set(key, flag.Value.String())
+		}
+	}
+
+	for key, value := range DefaultSettings().defaults() {
+		config.SetDefault(key, value)
+	}
+	config.SetDefault(configFileKey, DefaultConfigFile)
+	configFile := config.GetString(configFileKey)
+	if _, err := os.Stat(configFile); err == nil || configFile != DefaultConfigFile {
+		config.SetConfigFile(configFile)
+		err = config.ReadInConfig()
+		if err != nil {
+			return nil, fmt.Errorf("Can't read istio plugin configuration from %s: %s", configFile, err.Error())
+		}
+	}
+
+	settings := &Settings{}
+	err = config.Unmarshal(settings)
+	if err != nil {
+		return nil, fmt.Errorf("Can't load istio plugin configuration: %s", err.Error())
+	}
+	return settings, nil
+}
+
+func keysOf(values map[string]interface{}) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	return keys
+}
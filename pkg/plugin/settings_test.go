@@ -0,0 +1,175 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func writeConfigFile(g *GomegaWithT, content string) string {
+	dir, err := ioutil.TempDir("", "istio-plugin")
+	g.Expect(err).NotTo(HaveOccurred())
+	file := filepath.Join(dir, "config.yml")
+	g.Expect(ioutil.WriteFile(file, []byte(content), 0644)).To(Succeed())
+	return file
+}
+
+func TestLoadSettingsDefaults(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	settings, err := LoadSettings(nil)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(settings).To(Equal(DefaultSettings()))
+}
+
+func TestLoadSettingsFromFile(t *testing.T) {
+	g := NewGomegaWithT(t)
+	file := writeConfigFile(g, `
+consumer_id: client.istio.sapcloud.io
+network_profile: urn:local.test:public
+reconcile_interval: 1m
+reconcile_dry_run: true
+brokers:
+  Broker-A:
+    consumer_id: consumer-a
+    service_name_prefix: a-
+network_profiles:
+- service_id: postgres
+  network_profile: urn:local.test:private
+- broker_id: legacy
+  disabled: true
+`)
+	defer os.RemoveAll(filepath.Dir(file))
+
+	settings, err := LoadSettings([]string{"--istio.config_file=" + file})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(settings.ConsumerId).To(Equal("client.istio.sapcloud.io"))
+	g.Expect(settings.NetworkProfile).To(Equal("urn:local.test:public"))
+	g.Expect(settings.ServiceNamePrefix).To(Equal("istio-"))
+	g.Expect(settings.ReconcileInterval).To(Equal(time.Minute))
+	g.Expect(settings.ReconcileDryRun).To(BeTrue())
+	g.Expect(settings.Brokers).To(Equal(map[string]BrokerSettings{"broker-a": {ConsumerId: "consumer-a", ServiceNamePrefix: "a-"}}))
+	g.Expect(settings.NetworkProfiles).To(Equal([]NetworkProfileRule{
+		{ServiceId: "postgres", NetworkProfile: "urn:local.test:private"},
+		{BrokerId: "legacy", Disabled: true}}))
+}
+
+func TestLoadSettingsPrecedence(t *testing.T) {
+	g := NewGomegaWithT(t)
+	file := writeConfigFile(g, `
+consumer_id: from-file
+network_profile: from-file
+service_name_prefix: from-file-
+`)
+	defer os.RemoveAll(filepath.Dir(file))
+	os.Setenv("ISTIO_CONFIG_FILE", file)
+	os.Setenv("ISTIO_NETWORK_PROFILE", "from-env")
+	os.Setenv("ISTIO_CONSUMER_ID", "from-env")
+	defer os.Unsetenv("ISTIO_CONFIG_FILE")
+	defer os.Unsetenv("ISTIO_NETWORK_PROFILE")
+	defer os.Unsetenv("ISTIO_CONSUMER_ID")
+
+	settings, err := LoadSettings([]string{"--log.level=debug", "--istio.consumer_id", "from-flag"})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(settings.ServiceNamePrefix).To(Equal("from-file-"))
+	g.Expect(settings.NetworkProfile).To(Equal("from-env"))
+	g.Expect(settings.ConsumerId).To(Equal("from-flag"))
+}
+
+func TestLoadSettingsRetryPolicy(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	settings, err := LoadSettings([]string{"--istio.retry_max_attempts=3", "--istio.retry_timeout=30s"})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(settings.RetryPolicy()).To(Equal(RetryPolicy{
+		MaxAttempts:     3,
+		InitialInterval: DefaultRetryPolicy().InitialInterval,
+		MaxInterval:     DefaultRetryPolicy().MaxInterval,
+		Timeout:         30 * time.Second}))
+}
+
+func TestLoadSettingsMeshTopology(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	settings, err := LoadSettings([]string{"--istio.egress_gateway_namespace=egress", "--istio.cluster_domain=cluster.example.com",
+		"--istio.egress_gateway_selector=app=egress,tier=mesh", "--istio.egress_port=8443", "--istio.preserve_provider_port=true"})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(settings.MeshTopology()).To(Equal(MeshTopology{
+		ServicePort:           5555,
+		PreserveProviderPort:  true,
+		ClusterDomain:         "cluster.example.com",
+		EgressPort:            8443,
+		EgressGatewayHost:     "istio-egressgateway.egress.svc.cluster.example.com",
+		EgressGatewaySelector: map[string]string{"app": "egress", "tier": "mesh"}}))
+}
+
+func TestLoadSettingsMissingFile(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	_, err := LoadSettings([]string{"--istio.config_file=/does/not/exist.yml"})
+
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("/does/not/exist.yml"))
+}
+
+func TestLoadSettingsInvalidDuration(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	_, err := LoadSettings([]string{"--istio.reconcile_interval=often"})
+
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestSettingsValidate(t *testing.T) {
+	g := NewGomegaWithT(t)
+	valid := Settings{ConsumerId: "consumer", NetworkProfile: "urn:local.test:public", LogLevel: "info", RetryMaxAttempts: 1, LockTimeout: time.Second, CreateParallelism: 1}
+	g.Expect(valid.Validate()).To(Succeed())
+	overridden := valid
+	overridden.ConsumerId = ""
+	overridden.NetworkProfile = ""
+	overridden.Brokers = map[string]BrokerSettings{
+		"a": {ConsumerId: "consumer-a", NetworkProfile: "urn:local.test:a"},
+		"b": {ConsumerId: "consumer-b", NetworkProfile: "urn:local.test:b"}}
+	g.Expect(overridden.Validate()).To(Succeed())
+
+	for _, invalid := range []struct {
+		settings Settings
+		field    string
+	}{
+		{Settings{ConsumerId: "consumer"}, "network_profile"},
+		{Settings{NetworkProfile: "urn:local.test:public"}, "consumer_id"},
+		{Settings{ConsumerId: "consumer", Brokers: map[string]BrokerSettings{"a": {NetworkProfile: "profile"}, "b": {}}}, "network_profile"},
+		{Settings{NetworkProfile: "profile", Brokers: map[string]BrokerSettings{"a": {ConsumerId: "consumer-a"}, "b": {NetworkProfile: "profile"}}}, "consumer_id"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", LogLevel: "verbose"}, "log_level"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", ReconcileInterval: -1}, "reconcile_interval"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", AsyncBindTimeout: -1}, "async_bind_timeout"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", TargetNamespace: "Egress"}, "target_namespace"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", TargetNamespace: "egress", TargetNamespaceTemplate: "egress"}, "target_namespace"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", TargetNamespaceTemplate: "org-{{.context"}, "target_namespace_template"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", NetworkProfiles: []NetworkProfileRule{{PlanId: "plan"}}}, "network_profiles[0]"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile"}, "retry_max_attempts"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", RetryMaxAttempts: 1, RetryInitialInterval: time.Second}, "retry_initial_interval"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", RetryMaxAttempts: 1, RetryTimeout: -1}, "retry_timeout"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", RetryMaxAttempts: 1}, "lock_timeout"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", RetryMaxAttempts: 1, LockTimeout: time.Second, LockLease: true}, "lock_lease_duration"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", RetryMaxAttempts: 1, LockTimeout: time.Second}, "create_parallelism"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", RetryMaxAttempts: 1, LockTimeout: time.Second, CreateParallelism: 1, ServicePort: 70000}, "service_port"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", RetryMaxAttempts: 1, LockTimeout: time.Second, CreateParallelism: 1, EgressPort: -1}, "egress_port"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", RetryMaxAttempts: 1, LockTimeout: time.Second, CreateParallelism: 1, EgressGatewayNamespace: "Egress"}, "egress_gateway_namespace"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", RetryMaxAttempts: 1, LockTimeout: time.Second, CreateParallelism: 1, EgressGatewaySelector: "egress"}, "egress_gateway_selector"},
+		{Settings{ConsumerId: "consumer", NetworkProfile: "profile", RetryMaxAttempts: 1, LockTimeout: time.Second, CreateParallelism: 1, ClusterDomain: "cluster_local"}, "cluster_domain"},
+	} {
+		err := invalid.settings.Validate()
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring(invalid.field))
+	}
+}
@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// NewNamespaceTemplate parses a template that derives the target namespace of a binding, e.g. "org-{{.context.organization_guid}}".
+// The template is executed with the OSB context of the bind request as "context" and the "consumer_id",
+// "instance_id", "service_id" and "plan_id" of the binding.
+func NewNamespaceTemplate(text string) (*template.Template, error) {
+	return template.New("target_namespace").Option("missingkey=error").Parse(text)
+}
+
+// targetNamespace returns the namespace for the services and istio configs of a binding.
+// An empty namespace stands for the namespace of the plugin.
+func (c ConsumerInterceptor) targetNamespace(request model.BindRequest, metadata BindingMetadata) (string, error) {
+	if c.TargetNamespaceTemplate == nil {
+		return c.TargetNamespace, nil
+	}
+	var osbContext map[string]interface{}
+	if raw, ok := request.AdditionalProperties["context"]; ok {
+		err := json.Unmarshal(raw, &osbContext)
+		if err != nil {
+			return "", namespaceError("Invalid context: %s", err.Error())
+		}
+	}
+	var namespace bytes.Buffer
+	err := c.TargetNamespaceTemplate.Execute(&namespace, map[string]interface{}{
+		"context":     osbContext,
+		"consumer_id": metadata.ConsumerId,
+		"instance_id": metadata.InstanceId,
+		"service_id":  metadata.ServiceId,
+		"plan_id":     metadata.PlanId,
+	})
+	if err != nil {
+		return "", namespaceError("%s", err.Error())
+	}
+	result := strings.ToLower(namespace.String())
+	if errs := validation.IsDNS1123Label(result); len(errs) != 0 {
+		return "", namespaceError("%q is not a valid namespace: %s", result, strings.Join(errs, ", "))
+	}
+	return result, nil
+}
+
+// objectStore returns the store for the services and istio configs in the given target namespace
+func (c ConsumerInterceptor) objectStore(namespace string) ConfigStore {
+	if namespace == "" || namespace == c.ConfigStore.Namespace() {
+		return c.ConfigStore
+	}
+	return c.ConfigStore.InNamespace(namespace)
+}
+
+// fallbackNamespaces returns the namespaces that may hold the objects of a binding without record: the target
+// namespace, if it can be derived without the bind request, and the namespace of the plugin
+func (c ConsumerInterceptor) fallbackNamespaces(metadata BindingMetadata) []string {
+	var namespaces []string
+	namespace, err := c.targetNamespace(model.BindRequest{}, metadata)
+	if err != nil {
+		c.logger().Infof("Target namespace of binding %s can't be derived without the bind request: %s", metadata.BindingId, err.Error())
+	} else if namespace != "" && namespace != c.ConfigStore.Namespace() {
+		namespaces = append(namespaces, namespace)
+	}
+	return append(namespaces, c.ConfigStore.Namespace())
+}
+
+func namespaceError(format string, args ...interface{}) error {
+	return &model.HttpError{
+		ErrorMsg:   "Can't derive target namespace of binding: " + fmt.Sprintf(format, args...),
+		StatusCode: http.StatusBadRequest}
+}
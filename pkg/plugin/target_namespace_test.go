@@ -0,0 +1,174 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Peripli/istio-broker-proxy/pkg/model"
+	. "github.com/onsi/gomega"
+)
+
+func bindRequestWithContext(context string) model.BindRequest {
+	return model.BindRequest{AdditionalProperties: model.AdditionalProperties{"context": json.RawMessage(context)}}
+}
+
+func namespaceTemplate(g *GomegaWithT, text string) ConsumerInterceptor {
+	tmpl, err := NewNamespaceTemplate(text)
+	g.Expect(err).NotTo(HaveOccurred())
+	return ConsumerInterceptor{ConsumerId: "consumer", NetworkProfile: "urn:local.test:public",
+		ConfigStore: &MockConfigStore{ClusterIp: "10.0.0.1"}, TargetNamespaceTemplate: tmpl}
+}
+
+func TestConsumerInterceptorPostBindInTargetNamespace(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public", TargetNamespace: "egress"}
+
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.CreatedServices[0].Namespace).To(Equal("egress"))
+	for _, config := range configStore.CreatedIstioConfigs {
+		g.Expect(config.Namespace).To(Equal("egress"))
+	}
+	g.Expect(configStore.BindingRecords["bind-id"].Namespace).To(Equal("egress"))
+
+	binding, err := interceptor.PostFetchBinding(bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 5555}}))
+
+	err = interceptor.PostDelete("bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+	g.Expect(configStore.CreatedIstioConfigs).To(BeEmpty())
+	g.Expect(configStore.BindingRecords).To(BeEmpty())
+}
+
+func TestConsumerInterceptorDerivesTargetNamespaceFromContext(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := namespaceTemplate(g, "org-{{.context.organization_guid}}")
+	request := bindRequestWithContext(`{"platform": "cloudfoundry", "organization_guid": "ABC-123"}`)
+
+	_, err := interceptor.PreBind(request)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = interceptor.PostBind(request, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	configStore := interceptor.ConfigStore.(*MockConfigStore)
+	g.Expect(configStore.CreatedServices[0].Namespace).To(Equal("org-abc-123"))
+	g.Expect(configStore.BindingRecords["bind-id"].Namespace).To(Equal("org-abc-123"))
+}
+
+func TestConsumerInterceptorDerivesTargetNamespaceFromConsumer(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := namespaceTemplate(g, "consumer-{{.consumer_id}}")
+
+	namespace, err := interceptor.targetNamespace(model.BindRequest{}, BindingMetadata{ConsumerId: "client"})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(namespace).To(Equal("consumer-client"))
+}
+
+func TestConsumerInterceptorPreBindRejectsUnderivableNamespace(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := namespaceTemplate(g, "org-{{.context.organization_guid}}")
+
+	for _, request := range []model.BindRequest{
+		{},
+		bindRequestWithContext(`{"platform": "kubernetes"}`),
+		bindRequestWithContext(`{"organization_guid": "not_a_label"}`),
+	} {
+		_, err := interceptor.PreBind(request)
+
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("Can't derive target namespace"))
+		g.Expect(err.(*model.HttpError).StatusCode).To(Equal(http.StatusBadRequest))
+	}
+}
+
+func TestConsumerInterceptorAsyncBindUsesAcceptedNamespace(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := namespaceTemplate(g, "org-{{.context.organization_guid}}")
+	request := bindRequestWithContext(`{"organization_guid": "abc"}`)
+	configStore := interceptor.ConfigStore.(*MockConfigStore)
+
+	err := interceptor.PostBindAccepted(request, "bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.BindingRecords["bind-id"].Namespace).To(Equal("org-abc"))
+
+	_, err = interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.CreatedServices[0].Namespace).To(Equal("org-abc"))
+	g.Expect(configStore.BindingRecords["bind-id"].Services).To(HaveLen(1))
+}
+
+func TestReconcilerRemovesOrphansInTargetNamespaces(t *testing.T) {
+	g := NewGomegaWithT(t)
+	configStore := &MockConfigStore{ClusterIp: "10.0.0.1"}
+	interceptor := ConsumerInterceptor{ConfigStore: configStore, NetworkProfile: "urn:local.test:public", TargetNamespace: "egress"}
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "orphan-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	configStore.DeleteBindingRecord("orphan-id")
+	reconciler := NewReconciler(configStore, time.Minute, false)
+	reconciler.Namespaces = []string{"egress"}
+
+	orphans, err := reconciler.Reconcile()
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(orphans).To(HaveLen(1))
+	g.Expect(orphans[0].Namespace).To(Equal("egress"))
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+	g.Expect(configStore.CreatedIstioConfigs).To(BeEmpty())
+}
+
+func TestReconcilerRemovesOrphansInAllNamespaces(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := namespaceTemplate(g, "org-{{.context.organization_guid}}")
+	configStore := interceptor.ConfigStore.(*MockConfigStore)
+	for _, org := range []string{"alive", "orphan"} {
+		request := bindRequestWithContext(`{"organization_guid": "` + org + `"}`)
+		_, err := interceptor.PostBind(request, bindResponseWithEndpoints(providerEndpoint), org+"-id", adaptEndpoints)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	configStore.DeleteBindingRecord("orphan-id")
+	reconciler := NewReconciler(configStore, time.Minute, false)
+	reconciler.AllNamespaces = true
+
+	orphans, err := reconciler.Reconcile()
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(orphans).To(HaveLen(1))
+	g.Expect(orphans[0].BindingId).To(Equal("orphan-id"))
+	g.Expect(orphans[0].Namespace).To(Equal("org-orphan"))
+	g.Expect(configStore.CreatedServices).To(HaveLen(1))
+	g.Expect(configStore.CreatedServices[0].Namespace).To(Equal("org-alive"))
+}
+
+func TestConsumerInterceptorWithoutRecordUsesTargetNamespace(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := namespaceTemplate(g, "consumer-{{.consumer_id}}")
+	configStore := interceptor.ConfigStore.(*MockConfigStore)
+	_, err := interceptor.PostBind(model.BindRequest{}, bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.DeleteBindingRecord("bind-id")).To(Succeed())
+
+	binding, err := interceptor.PostFetchBinding(bindResponseWithEndpoints(providerEndpoint), "bind-id", adaptEndpoints)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(binding.Endpoints).To(Equal([]model.Endpoint{{Host: "10.0.0.1", Port: 5555}}))
+
+	err = interceptor.PostDelete("bind-id")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configStore.CreatedServices).To(BeEmpty())
+	g.Expect(configStore.CreatedIstioConfigs).To(BeEmpty())
+}
+
+func TestConsumerInterceptorWithoutRecordSkipsUnderivableTargetNamespace(t *testing.T) {
+	g := NewGomegaWithT(t)
+	interceptor := namespaceTemplate(g, "org-{{.context.organization_guid}}")
+
+	g.Expect(interceptor.fallbackNamespaces(BindingMetadata{BindingId: "bind-id"})).To(Equal([]string{"catalog"}))
+	g.Expect(interceptor.PostDelete("bind-id")).To(Succeed())
+}